@@ -0,0 +1,227 @@
+package nps_mux
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	initialSessionWindow = maximumSegmentSize * 256 // both sides assumed before the first session window update
+	defaultSessionBudget = maximumWindowSize
+)
+
+// sessionReceiveWindow limit the stream data buffered by all the streams of the mux, like the HTTP/2 connection window.
+// it advertise the absolute offset of stream data the remote side can send, so the update frames are idempotent.
+type sessionReceiveWindow struct {
+	consumed   uint64 // stream data read by application or dropped
+	advertised uint64 // the offset advertised to the remote side
+	budget     uint32
+	started    uint32
+	mux        *Mux
+}
+
+func newSessionReceiveWindow(mux *Mux) *sessionReceiveWindow {
+	return &sessionReceiveWindow{
+		advertised: initialSessionWindow,
+		budget:     defaultSessionBudget,
+		mux:        mux,
+	}
+}
+
+func (Self *sessionReceiveWindow) Consume(n uint32) {
+	if n == 0 {
+		return
+	}
+	Self.update(atomic.AddUint64(&Self.consumed, uint64(n)))
+}
+
+// Start advertise the budget when the first stream data received,
+// otherwise the streams not read may hold the initial session window, and the others can't receive anything
+func (Self *sessionReceiveWindow) Start() {
+	if atomic.LoadUint32(&Self.started) == 0 && atomic.CompareAndSwapUint32(&Self.started, 0, 1) {
+		Self.update(atomic.LoadUint64(&Self.consumed))
+	}
+}
+
+func (Self *sessionReceiveWindow) SetBudget(n uint32) {
+	atomic.StoreUint32(&Self.budget, n)
+	Self.update(atomic.LoadUint64(&Self.consumed))
+}
+
+// Readvertise send the advertised offset again, the remote side asked for it, or just announced the session window
+func (Self *sessionReceiveWindow) Readvertise() {
+	Self.update(atomic.LoadUint64(&Self.consumed))
+	if Self.mux.remoteCapable(capSessionWindow) {
+		Self.mux.sendInfo(muxSessionWindow, 0, atomic.LoadUint64(&Self.advertised))
+	}
+}
+
+func (Self *sessionReceiveWindow) update(consumed uint64) {
+	budget := uint64(atomic.LoadUint32(&Self.budget))
+	limit := consumed + budget
+	for {
+		advertised := atomic.LoadUint64(&Self.advertised)
+		if limit <= advertised || limit-advertised < budget/2 {
+			// not free up enough space, or the budget shrink, wait for more data consumed
+			return
+		}
+		if atomic.CompareAndSwapUint64(&Self.advertised, advertised, limit) {
+			if Self.mux.remoteCapable(capSessionWindow) {
+				// the old peers don't limit the session, and don't know the frame
+				Self.mux.sendInfo(muxSessionWindow, 0, limit)
+				Self.mux.traceWindow(sessionQueueId, true, limit, 0)
+			}
+			return
+		}
+	}
+}
+
+// sessionSendWindow is the remote side sessionReceiveWindow,
+// all the streams acquire the send size from it before sending data.
+// it is not enabled until the remote side announced the session window, the old peers never advertise it.
+type sessionSendWindow struct {
+	sent    uint64 // stream data sent
+	limit   uint64 // the offset remote side allowed
+	enabled uint32
+	notify  chan struct{}
+	mux     *Mux
+	sync.Mutex
+}
+
+func newSessionSendWindow(mux *Mux) *sessionSendWindow {
+	return &sessionSendWindow{
+		limit:  initialSessionWindow,
+		notify: make(chan struct{}),
+		mux:    mux,
+	}
+}
+
+func (Self *sessionSendWindow) SetLimit(limit uint64) {
+	Self.Lock()
+	if limit > atomic.LoadUint64(&Self.limit) {
+		// the update frames may duplicate, only the larger offset is useful
+		atomic.StoreUint64(&Self.limit, limit)
+		Self.mux.traceWindow(sessionQueueId, false, limit, 0)
+		close(Self.notify)
+		Self.notify = make(chan struct{})
+		// wake up all the waiting streams
+	}
+	Self.Unlock()
+}
+
+// Enable limit the streams by the session window, the remote side announced it
+func (Self *sessionSendWindow) Enable() {
+	atomic.StoreUint32(&Self.enabled, 1)
+}
+
+func (Self *sessionSendWindow) isEnabled() bool {
+	return atomic.LoadUint32(&Self.enabled) == 1
+}
+
+// Remaining returns the bytes can be sent now, math.MaxUint64 if the session window is not enabled
+func (Self *sessionSendWindow) Remaining() uint64 {
+	if !Self.isEnabled() {
+		return math.MaxUint64
+	}
+	sent := atomic.LoadUint64(&Self.sent)
+	limit := atomic.LoadUint64(&Self.limit)
+	if limit > sent {
+		return limit - sent
+	}
+	return 0
+}
+
+// TryAcquire acquire the size if the session window is enough now, never wait
+func (Self *sessionSendWindow) TryAcquire(size uint32) bool {
+	if !Self.isEnabled() {
+		atomic.AddUint64(&Self.sent, uint64(size))
+		return true
+	}
+	for {
+		sent := atomic.LoadUint64(&Self.sent)
+		if atomic.LoadUint64(&Self.limit) < sent+uint64(size) {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&Self.sent, sent, sent+uint64(size)) {
+			return true
+		}
+	}
+}
+
+// Acquire wait for the session window and returns the size can be sent now, no more than size
+func (Self *sessionSendWindow) Acquire(size uint32, timeout time.Time, closeCh <-chan struct{}, muxCloseCh <-chan struct{}) (n uint32, err error) {
+	var probe *time.Timer
+	var interval time.Duration
+	if !Self.isEnabled() {
+		atomic.AddUint64(&Self.sent, uint64(size))
+		return size, nil
+		// the sent offset is still counted, the remote side count from the start too
+	}
+	for {
+		Self.Lock()
+		notify := Self.notify
+		Self.Unlock()
+		// get the notify channel first, make sure we don't miss the update
+		sent := atomic.LoadUint64(&Self.sent)
+		limit := atomic.LoadUint64(&Self.limit)
+		if limit > sent {
+			n = size
+			if uint64(n) > limit-sent {
+				n = uint32(limit - sent)
+			}
+			if atomic.CompareAndSwapUint64(&Self.sent, sent, sent+uint64(n)) {
+				return
+			}
+			continue // another stream acquired
+		}
+		var timer *time.Timer
+		var timeoutCh <-chan time.Time
+		if !timeout.IsZero() {
+			t := timeout.Sub(time.Now())
+			if t <= 0 {
+				return 0, errors.New("conn.writeWindow: write to time out")
+			}
+			timer = time.NewTimer(t)
+			timeoutCh = timer.C
+		}
+		if probe == nil {
+			interval = Self.mux.probeInterval()
+			probe = time.NewTimer(interval)
+			defer probe.Stop()
+		}
+		select {
+		case <-notify:
+		case <-timeoutCh:
+			err = errors.New("conn.writeWindow: write to time out")
+		case <-closeCh:
+			err = errors.New("conn.writeWindow: window closed")
+		case <-muxCloseCh:
+			err = errors.New("the mux has closed")
+		case <-probe.C:
+			// no session window update for a while, maybe lost, ask for it
+			Self.mux.sendInfo(muxWindowProbe, sessionQueueId, nil)
+			interval = nextProbeInterval(interval)
+			probe.Reset(interval)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// SetReceiveBudget Set the max bytes of stream data can be buffered by all the streams of the mux,
+// the remote side can't send more no matter how many streams are opened.
+// the budget is advertised when the stream data is read, so Set it before the streams opened,
+// the remote side assume a small initial budget before that.
+func (s *Mux) SetReceiveBudget(n uint32) {
+	if n < maximumSegmentSize {
+		n = maximumSegmentSize
+	}
+	s.receiveBudget.SetBudget(n)
+}
@@ -0,0 +1,73 @@
+package nps_mux
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrNotSupported is returned while sending the frames of a feature the remote side has not announced
+var ErrNotSupported = errors.New("mux: the remote side does not support the feature")
+
+// the features announced to the remote side by muxCapabilities, the frames of a feature
+// are only sent after the remote side announced it, so the peers of the old versions still work.
+// the announcement is a header only frame, the old peers just drop it.
+// it is the first frame sent, so the peer never announce it if any other frame received first.
+const (
+	capSessionWindow  uint32 = 1 << iota // muxSessionWindow, the session window shared by all the streams
+	capWindowOffset                      // muxWindowUpdate, the stream window update by the absolute offset
+	capSessionMessage                    // muxSessionMsg, muxSessionMsgPart and muxSessionMsgRead
+	capDatagram                          // muxDatagram
+)
+
+// localCapabilities is the features this side supports
+const localCapabilities = capSessionWindow | capWindowOffset | capSessionMessage | capDatagram
+
+func (s *Mux) announceCapabilities() {
+	s.sendInfo(muxCapabilities, int32(localCapabilities), nil)
+}
+
+// capabilitiesKnown is called at the first frame received, the remote side announced the features or never will
+func (s *Mux) capabilitiesKnown() {
+	s.capsOnce.Do(func() {
+		close(s.capsKnown)
+	})
+}
+
+// capabilitiesReceived reports whether the first frame of the remote side received
+func (s *Mux) capabilitiesReceived() bool {
+	select {
+	case <-s.capsKnown:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitCapabilities wait for the first frame of the remote side, the features it supports are known after that
+func (s *Mux) waitCapabilities(ctx context.Context) error {
+	select {
+	case <-s.capsKnown:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.closeChan:
+		return errors.New("the mux has closed")
+	}
+}
+
+// remoteCapable reports whether the remote side announced the feature
+func (s *Mux) remoteCapable(feature uint32) bool {
+	return atomic.LoadUint32(&s.remoteCaps)&feature != 0
+}
+
+func (s *Mux) setRemoteCapabilities(caps uint32) {
+	caps &= localCapabilities // the features unknown to this side are never used
+	atomic.StoreUint32(&s.remoteCaps, caps)
+	if caps&capSessionWindow != 0 {
+		s.receiveBudget.Readvertise()
+		// the offset advertised before the announcement is not sent yet
+		s.sendBudget.Enable()
+	}
+	s.capabilitiesKnown()
+}
@@ -0,0 +1,244 @@
+package nps_mux
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// the capture file is the header, then the frame records:
+//
+//	magic "NPSMUXCAP" | version byte | start time unix nano uint64
+//
+// every record is:
+//
+//	uvarint nanoseconds since the last record | direction byte, 0 sent 1 received | flag byte | id uint32 |
+//	content frames: uvarint length | uvarint captured length | captured content
+//	window frames: window uint64 | stream window update: size uint32
+//
+// the integers are little endian like the frames on the wire
+const (
+	captureMagic   = "NPSMUXCAP"
+	captureVersion = 1
+)
+
+var errCaptureFormat = errors.New("capture: not a mux capture file")
+
+// CapturedFrame is a frame decoded from the capture file or the raw stream
+type CapturedFrame struct {
+	Time time.Time // zero for the raw stream
+	Sent bool      // sent by the mux captured, always false for the raw stream
+	FrameInfo
+	Payload []byte // the content captured, may be truncated
+}
+
+type frameCapture struct {
+	w       *bufio.Writer
+	payload int
+	last    int64 // unix nano of the last record
+	err     error
+	buf     [binary.MaxVarintLen64*3 + 6]byte // the largest record header
+	sync.Mutex
+}
+
+type frameCaptureValue struct {
+	*frameCapture
+}
+
+// StartCapture record the frames sent and received to w until StopCapture called or the mux closed,
+// the content of the frames is truncated to payload bytes, zero records the headers only.
+// it's on the read and write path, w should be fast, e.g. a file.
+func (s *Mux) StartCapture(w io.Writer, payload int) error {
+	if payload < 0 {
+		payload = 0
+	}
+	c := &frameCapture{w: bufio.NewWriter(w), payload: payload, last: time.Now().UnixNano()}
+	var header [len(captureMagic) + 9]byte
+	copy(header[:], captureMagic)
+	header[len(captureMagic)] = captureVersion
+	binary.LittleEndian.PutUint64(header[len(captureMagic)+1:], uint64(c.last))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if err := s.StopCapture(); err != nil {
+		return err
+	}
+	s.capture.Store(frameCaptureValue{c})
+	return nil
+}
+
+// StopCapture stop recording and flush the records, returns the error of writing the capture
+func (s *Mux) StopCapture() error {
+	v, ok := s.capture.Load().(frameCaptureValue)
+	if !ok || v.frameCapture == nil {
+		return nil
+	}
+	s.capture.Store(frameCaptureValue{})
+	return v.stop()
+}
+
+func (s *Mux) getCapture() *frameCapture {
+	if v, ok := s.capture.Load().(frameCaptureValue); ok {
+		return v.frameCapture
+	}
+	return nil
+}
+
+func (Self *frameCapture) record(sent bool, pack *muxPackager) {
+	Self.Lock()
+	defer Self.Unlock()
+	if Self.err != nil || Self.w == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	delta := now - Self.last
+	if delta < 0 {
+		delta = 0 // the read and write session race for the lock
+	} else {
+		Self.last = now
+	}
+	buf := Self.buf[:]
+	n := binary.PutUvarint(buf, uint64(delta))
+	if sent {
+		buf[n] = 0
+	} else {
+		buf[n] = 1
+	}
+	buf[n+1] = pack.flag
+	binary.LittleEndian.PutUint32(buf[n+2:], uint32(pack.id))
+	n += 6
+	var content []byte
+	switch {
+	case hasContent(pack.flag):
+		content = pack.content[:pack.length]
+		if len(content) > Self.payload {
+			content = content[:Self.payload]
+		}
+		n += binary.PutUvarint(buf[n:], uint64(pack.length))
+		n += binary.PutUvarint(buf[n:], uint64(len(content)))
+	case hasWindowSize(pack.flag):
+		binary.LittleEndian.PutUint64(buf[n:], pack.window)
+		binary.LittleEndian.PutUint32(buf[n+8:], pack.size)
+		n += 12
+	case hasWindow(pack.flag):
+		binary.LittleEndian.PutUint64(buf[n:], pack.window)
+		n += 8
+	}
+	if _, Self.err = Self.w.Write(buf[:n]); Self.err == nil && len(content) > 0 {
+		_, Self.err = Self.w.Write(content)
+	}
+}
+
+func (Self *frameCapture) stop() error {
+	Self.Lock()
+	defer Self.Unlock()
+	if Self.w == nil {
+		return Self.err
+	}
+	if Self.err == nil {
+		Self.err = Self.w.Flush()
+	}
+	Self.w = nil
+	return Self.err
+}
+
+// CaptureReader decode the capture file written by StartCapture
+type CaptureReader struct {
+	r    *bufio.Reader
+	last int64
+}
+
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	var header [len(captureMagic) + 9]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errCaptureFormat
+	}
+	if !bytes.Equal(header[:len(captureMagic)], []byte(captureMagic)) || header[len(captureMagic)] != captureVersion {
+		return nil, errCaptureFormat
+	}
+	return &CaptureReader{
+		r:    bufio.NewReader(r),
+		last: int64(binary.LittleEndian.Uint64(header[len(captureMagic)+1:])),
+	}, nil
+}
+
+// Next returns the next frame recorded, io.EOF at the end of the capture
+func (Self *CaptureReader) Next() (frame CapturedFrame, err error) {
+	delta, err := binary.ReadUvarint(Self.r)
+	if err != nil {
+		return // io.EOF if the capture ends between the records
+	}
+	var header [6]byte
+	if _, err = io.ReadFull(Self.r, header[:]); err != nil {
+		return frame, io.ErrUnexpectedEOF
+	}
+	Self.last += int64(delta)
+	frame.Time = time.Unix(0, Self.last)
+	frame.Sent = header[0] == 0
+	frame.Flag = header[1]
+	frame.Type = frameNames[frameIndex(frame.Flag)]
+	frame.Stream = int32(binary.LittleEndian.Uint32(header[2:]))
+	switch {
+	case hasContent(frame.Flag):
+		var length, captured uint64
+		if length, err = binary.ReadUvarint(Self.r); err == nil {
+			captured, err = binary.ReadUvarint(Self.r)
+		}
+		if err != nil || captured > length || length > maximumSegmentSize {
+			return frame, errCaptureFormat
+		}
+		frame.Length = uint16(length)
+		frame.Payload = make([]byte, captured)
+		_, err = io.ReadFull(Self.r, frame.Payload)
+	case hasWindowSize(frame.Flag):
+		var buf [12]byte
+		_, err = io.ReadFull(Self.r, buf[:])
+		frame.Window = binary.LittleEndian.Uint64(buf[:8])
+		frame.Size = binary.LittleEndian.Uint32(buf[8:])
+	case hasWindow(frame.Flag):
+		var buf [8]byte
+		_, err = io.ReadFull(Self.r, buf[:])
+		frame.Window = binary.LittleEndian.Uint64(buf[:])
+		frame.legacyWindow()
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// FrameReader decode the frames from the raw stream of one direction of a mux connection,
+// e.g. a TCP stream dump, the frames have no time and direction
+type FrameReader struct {
+	r io.Reader
+}
+
+func NewFrameReader(r io.Reader) *FrameReader {
+	return &FrameReader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next frame of the stream, io.EOF at the end of the stream
+func (Self *FrameReader) Next() (frame CapturedFrame, err error) {
+	pack := muxPack.Get()
+	defer muxPack.Put(pack)
+	var n uint16
+	if n, err = pack.UnPack(Self.r); err != nil {
+		if hasContent(pack.flag) && pack.content != nil {
+			windowBuff.Put(pack.content)
+		}
+		if err == io.EOF && n > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	frame.FrameInfo = pack.frameInfo()
+	if hasContent(pack.flag) {
+		frame.Payload = append([]byte(nil), pack.content[:pack.length]...)
+		windowBuff.Put(pack.content)
+	}
+	return
+}
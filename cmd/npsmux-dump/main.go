@@ -0,0 +1,205 @@
+// Command npsmux-dump prints the frames of a mux capture file written by Mux.StartCapture,
+// or of a raw stream of one direction of a mux connection, e.g. a TCP stream dump.
+//
+//	npsmux-dump [-raw] [-payload n] [-streams] [-windows] [-q] file
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	nps_mux "ehang.io/nps-mux"
+)
+
+var (
+	raw     = flag.Bool("raw", false, "the file is a raw stream of one direction of a mux connection")
+	payload = flag.Int("payload", 0, "print the first n bytes of the content in hex")
+	streams = flag.Bool("streams", false, "print the timeline of every stream")
+	windows = flag.Bool("windows", false, "print the window evolution")
+	quiet   = flag.Bool("q", false, "don't print the frames")
+)
+
+type frameReader interface {
+	Next() (nps_mux.CapturedFrame, error)
+}
+
+type event struct {
+	at   string
+	desc string
+}
+
+// stream is the timeline of a stream
+type stream struct {
+	id       int32
+	events   []event
+	sent     uint64 // stream data bytes
+	received uint64
+	frames   int
+	data     bool // the stream data seen
+}
+
+type windowChange struct {
+	at     string
+	sent   bool
+	stream int32
+	window uint64
+	size   uint32
+	legacy bool // the update of the old peers, window is the size read since the last update
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: npsmux-dump [-raw] [-payload n] [-streams] [-windows] [-q] file")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	var r frameReader
+	if *raw {
+		r = nps_mux.NewFrameReader(f)
+	} else if r, err = nps_mux.NewCaptureReader(f); err != nil {
+		log.Fatal(err, ", use -raw for the raw stream")
+	}
+	var start time.Time
+	timeline := make(map[int32]*stream)
+	var changes []windowChange
+	for i := 0; ; i++ {
+		frame, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal("frame ", i, ": ", err)
+		}
+		// the raw stream has no time, the frame index instead
+		at := fmt.Sprintf("#%d", i)
+		if !frame.Time.IsZero() {
+			if start.IsZero() {
+				start = frame.Time
+			}
+			at = fmt.Sprintf("%.6f", frame.Time.Sub(start).Seconds())
+		}
+		dir := "recv"
+		if frame.Sent {
+			dir = "send"
+		}
+		if *raw {
+			dir = "-"
+		}
+		if !*quiet {
+			printFrame(at, dir, frame)
+		}
+		switch frame.Type {
+		case "window_update", "msg_send_ok", "session_window":
+			changes = append(changes, windowChange{at: at, sent: frame.Sent, stream: frame.Stream, window: frame.Window,
+				size: frame.Size, legacy: frame.Type == "msg_send_ok"})
+		case "new_conn", "new_conn_ok", "new_conn_fail", "conn_close", "new_msg", "new_msg_part":
+			s, ok := timeline[frame.Stream]
+			if !ok {
+				s = &stream{id: frame.Stream}
+				timeline[frame.Stream] = s
+			}
+			s.frames++
+			if frame.Type == "new_msg" || frame.Type == "new_msg_part" {
+				if frame.Sent {
+					s.sent += uint64(frame.Length)
+				} else {
+					s.received += uint64(frame.Length)
+				}
+				if !s.data {
+					s.data = true
+					s.events = append(s.events, event{at, dir + " first data"})
+				}
+				continue
+			}
+			s.events = append(s.events, event{at, dir + " " + frame.Type})
+		}
+	}
+	if *streams {
+		printStreams(timeline)
+	}
+	if *windows {
+		printWindows(changes)
+	}
+}
+
+func printFrame(at, dir string, frame nps_mux.CapturedFrame) {
+	line := fmt.Sprintf("%-12s %s %-16s id=%d", at, dir, frame.Type, frame.Stream)
+	if frame.Type == "extension" {
+		line += fmt.Sprintf(" flag=%#x", frame.Flag)
+	}
+	switch frame.Type {
+	case "window_update":
+		line += fmt.Sprintf(" offset=%d size=%d limit=%d", frame.Window, frame.Size, frame.Window+uint64(frame.Size))
+	case "msg_send_ok":
+		line += fmt.Sprintf(" read=%d size=%d", frame.Window, frame.Size)
+	case "session_window":
+		line += fmt.Sprintf(" limit=%d", frame.Window)
+	default:
+		if frame.Length > 0 || frame.Payload != nil {
+			line += fmt.Sprintf(" len=%d", frame.Length)
+		}
+	}
+	if n := *payload; n > 0 && len(frame.Payload) > 0 {
+		p := frame.Payload
+		if len(p) > n {
+			p = p[:n]
+		}
+		line += " " + hex.EncodeToString(p)
+	}
+	fmt.Println(line)
+}
+
+func printStreams(timeline map[int32]*stream) {
+	ids := make([]int, 0, len(timeline))
+	for id := range timeline {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	fmt.Println()
+	fmt.Println("streams:")
+	for _, id := range ids {
+		s := timeline[int32(id)]
+		fmt.Printf("stream %d: %d frames, data sent %d received %d\n", s.id, s.frames, s.sent, s.received)
+		for _, e := range s.events {
+			fmt.Printf("  %-12s %s\n", e.at, e.desc)
+		}
+	}
+}
+
+func printWindows(changes []windowChange) {
+	fmt.Println()
+	fmt.Println("windows:")
+	for _, c := range changes {
+		// the window frames sent advertise the local receive window, the received ones update the send window
+		dir := "remote"
+		if c.sent {
+			dir = "local"
+		}
+		if c.stream == 0 {
+			fmt.Printf("  %-12s session %-6s limit=%d\n", c.at, dir, c.window)
+			continue
+		}
+		if c.legacy {
+			fmt.Printf("  %-12s stream %d %-6s read=%d size=%d\n", c.at, c.stream, dir, c.window, c.size)
+			continue
+		}
+		fmt.Printf("  %-12s stream %d %-6s offset=%d size=%d limit=%d\n", c.at, c.stream, dir, c.window, c.size,
+			c.window+uint64(c.size))
+	}
+}
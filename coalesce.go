@@ -0,0 +1,133 @@
+package nps_mux
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// coalesceDelay is the longest time a small write wait for the following writes
+const coalesceDelay = time.Millisecond * 5
+
+// writeCoalescer buffer the small writes of a stream into one segment, like the Nagle algorithm.
+// the lock only protect the buffer, it is never held while sending, the sending may wait for the window,
+// sending is held instead, so the buffered writes and the following writes never reorder.
+type writeCoalescer struct {
+	enabled uint32
+	buf     []byte
+	timer   *time.Timer
+	err     error // the error of the delayed flush, returned by the next write
+	sending sync.Mutex
+	sync.Mutex
+}
+
+// take swap out the buffered writes, or returns the error of the delayed flush
+func (Self *writeCoalescer) take() (buf []byte, err error) {
+	Self.Lock()
+	defer Self.Unlock()
+	if Self.timer != nil {
+		Self.timer.Stop()
+		Self.timer = nil
+	}
+	if err = Self.err; err != nil {
+		Self.err = nil
+		return
+	}
+	if len(Self.buf) > 0 {
+		buf = Self.buf
+		Self.buf = nil
+	}
+	return
+}
+
+// add append p to the buffer as much as it can hold, full reports whether the buffer is a full segment now
+func (Self *writeCoalescer) add(p []byte, flush func()) (n int, full bool, err error) {
+	Self.Lock()
+	defer Self.Unlock()
+	if err = Self.err; err != nil {
+		Self.err = nil
+		return
+	}
+	if Self.buf == nil {
+		Self.buf = windowBuff.Get()[:0]
+	}
+	n = copy(Self.buf[len(Self.buf):maximumSegmentSize], p)
+	Self.buf = Self.buf[:len(Self.buf)+n]
+	full = len(Self.buf) == maximumSegmentSize
+	if !full && Self.timer == nil {
+		Self.timer = time.AfterFunc(coalesceDelay, flush)
+	}
+	return
+}
+
+// SetNoDelay Set whether the small writes are sent immediately, the default is true like the *net.TCPConn.
+// if false, the writes smaller than a segment are buffered until the segment filled,
+// the delay passed or Flush called, so the chatty streams use far fewer frames
+func (s *conn) SetNoDelay(noDelay bool) error {
+	if noDelay {
+		atomic.StoreUint32(&s.coalescer.enabled, 0)
+		return s.Flush()
+	}
+	atomic.StoreUint32(&s.coalescer.enabled, 1)
+	return nil
+}
+
+// Flush send the buffered writes immediately
+func (s *conn) Flush() error {
+	s.coalescer.sending.Lock()
+	defer s.coalescer.sending.Unlock()
+	return s.flush()
+}
+
+// flush send the buffered writes, the caller holds the sending lock
+func (s *conn) flush() (err error) {
+	buf, err := s.coalescer.take()
+	if err != nil || buf == nil {
+		return
+	}
+	defer windowBuff.Put(buf)
+	if s.receiveWindow.mux.IsClose {
+		return errors.New("the mux has closed")
+	}
+	_, err = s.sendWindow.WriteFull(buf, s.connId)
+	return
+}
+
+// delayedFlush send the buffered writes after the delay, the error is returned by the next write
+func (s *conn) delayedFlush() {
+	s.coalescer.sending.Lock()
+	err := s.flush()
+	s.coalescer.sending.Unlock()
+	if err != nil {
+		s.coalescer.Lock()
+		s.coalescer.err = err
+		s.coalescer.Unlock()
+	}
+}
+
+func (s *conn) coalesce(buf []byte) (n int, err error) {
+	if len(buf) >= maximumSegmentSize {
+		// large enough, no need to buffer, send it after the buffered writes
+		s.coalescer.sending.Lock()
+		defer s.coalescer.sending.Unlock()
+		if err = s.flush(); err != nil {
+			return
+		}
+		return s.sendWindow.WriteFull(buf, s.connId)
+	}
+	for len(buf) > 0 {
+		l, full, err := s.coalescer.add(buf, s.delayedFlush)
+		if err != nil {
+			return n, err
+		}
+		n += l
+		buf = buf[l:]
+		if full {
+			if err = s.Flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+	return
+}
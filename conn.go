@@ -3,16 +3,15 @@ package nps_mux
 import (
 	"errors"
 	"io"
-	"log"
 	"math"
 	"net"
-	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type conn struct {
+	maxMessageSize int64 // accessed by atomics, first for the 64 bits alignment
 	net.Conn
 	connStatusOkCh   chan struct{}
 	connStatusFailCh chan struct{}
@@ -21,6 +20,7 @@ type conn struct {
 	closingFlag      bool // closing conn flag
 	receiveWindow    *receiveWindow
 	sendWindow       *sendWindow
+	coalescer        writeCoalescer
 	once             sync.Once
 }
 
@@ -34,7 +34,7 @@ func NewConn(connId int32, mux *Mux) *conn {
 		once:             sync.Once{},
 	}
 	c.receiveWindow.New(mux)
-	c.sendWindow.New(mux)
+	c.sendWindow.New(mux, connId)
 	return c
 }
 
@@ -60,11 +60,121 @@ func (s *conn) Write(buf []byte) (n int, err error) {
 	if len(buf) == 0 {
 		return 0, nil
 	}
+	if atomic.LoadUint32(&s.coalescer.enabled) == 1 {
+		return s.coalesce(buf)
+	}
 	n, err = s.sendWindow.WriteFull(buf, s.connId)
 	return
 }
 
+// ReadFrom read from r into the segment buffers and send them as the frames directly,
+// without the buffer of io.Copy and the copy into the frames
+func (s *conn) ReadFrom(r io.Reader) (n int64, err error) {
+	if s.isClose {
+		return 0, errors.New("the conn has closed")
+	}
+	if s.closingFlag {
+		return 0, errors.New("io: write on closed conn")
+	}
+	s.coalescer.sending.Lock()
+	err = s.flush()
+	s.coalescer.sending.Unlock()
+	if err != nil {
+		return
+	}
+	// the lock is not held while reading r, it may block for long, Close and Flush must not wait for it
+	var l int
+	var rErr error
+	for {
+		buf := windowBuff.Get()
+		l, rErr = r.Read(buf)
+		if l > 0 {
+			if err = s.sendWindow.sendSegment(buf[:l], s.connId); err != nil {
+				return
+			}
+			n += int64(l)
+		} else {
+			windowBuff.Put(buf)
+		}
+		if rErr == io.EOF {
+			return
+		}
+		if rErr != nil {
+			return n, rErr
+		}
+	}
+}
+
+// WriteTo write the received data to w directly, without the buffer of io.Copy
+func (s *conn) WriteTo(w io.Writer) (n int64, err error) {
+	if s.isClose {
+		return 0, errors.New("the conn has closed")
+	}
+	return s.receiveWindow.WriteTo(w, s.connId)
+}
+
+// SetPriority Set the priority level of the data written later, PriorityHigh for the latency-sensitive stream,
+// PriorityLow for the bulk transfer stream, the default is PriorityNormal
+func (s *conn) SetPriority(level uint8) error {
+	if level >= priorityLevels {
+		return errors.New("conn: unknown priority level")
+	}
+	atomic.StoreUint32(&s.sendWindow.priority, uint32(level))
+	return nil
+}
+
+// MinReadBuffer is the smallest read buffer of a stream, the window the remote side can send before the first update
+const MinReadBuffer = initialWindowSize
+
+// SetReadBuffer Set the max receive window the stream advertise, like the SO_RCVBUF,
+// the remote side can't send more than the bytes before they are read.
+// it returns an error if bytes is less than MinReadBuffer, the larger than the max window size is capped
+func (s *conn) SetReadBuffer(bytes int) error {
+	if bytes < MinReadBuffer {
+		return errors.New("conn: read buffer smaller than the initial window")
+	}
+	n, err := bufferSize(bytes)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&s.receiveWindow.readBuffer, n)
+	if atomic.LoadUint32(&s.receiveWindow.maxSize) > n {
+		atomic.StoreUint32(&s.receiveWindow.maxSize, n)
+	}
+	return nil
+}
+
+// SetWriteBuffer Set the max bytes written but not read by the remote side, like the SO_SNDBUF,
+// Write blocks when the remote side allows more but the bytes not acknowledged reach the size
+func (s *conn) SetWriteBuffer(bytes int) error {
+	n, err := bufferSize(bytes)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&s.sendWindow.writeBuffer, n)
+	s.sendWindow.notify() // the writer may wait for the larger buffer
+	return nil
+}
+
+func bufferSize(bytes int) (uint32, error) {
+	if bytes <= 0 {
+		return 0, errors.New("conn: invalid buffer size")
+	}
+	if bytes < maximumSegmentSize {
+		return maximumSegmentSize, nil
+	}
+	if bytes > maximumWindowSize {
+		return maximumWindowSize, nil
+	}
+	return uint32(bytes), nil
+}
+
 func (s *conn) Close() (err error) {
+	if !s.isClose {
+		// send the coalesced writes before the close, it waits for the window like Write,
+		// no longer than the write deadline, or until the mux closed
+		_ = s.Flush()
+	}
 	s.once.Do(s.closeProcess)
 	return
 }
@@ -75,10 +185,11 @@ func (s *conn) closeProcess() {
 	if !s.receiveWindow.mux.IsClose {
 		// if server or user close the conn while reading, will Get a io.EOF
 		// and this Close method will be invoke, send this signal to close other side
-		s.receiveWindow.mux.sendInfo(muxConnClose, s.connId, nil)
+		s.receiveWindow.mux.sendPriorityInfo(muxConnClose, s.connId, s.sendWindow.Priority(), nil)
 	}
 	s.sendWindow.CloseWindow()
 	s.receiveWindow.CloseWindow()
+	s.receiveWindow.mux.traceStream(s.connId, StreamClosed)
 	return
 }
 
@@ -107,42 +218,27 @@ func (s *conn) SetWriteDeadline(t time.Time) error {
 }
 
 type window struct {
-	maxSizeDone uint64
-	// 64bit alignment
-	// maxSizeDone contains 4 parts
-	//   1       31       1      31
-	// wait   maxSize  useless  done
-	// wait zero means false, one means true
 	off       uint32
-	closeOp   bool
+	closeOp   uint32 // one after the window closed, read by the timers of the delayed updates too
 	closeOpCh chan struct{}
 	mux       *Mux
 }
 
-const windowBits = 31
-const waitBits = dequeueBits + windowBits
-const mask1 = 1
-const mask31 = 1<<windowBits - 1
-
-func (Self *window) unpack(ptrs uint64) (maxSize, done uint32, wait bool) {
-	maxSize = uint32((ptrs >> dequeueBits) & mask31)
-	done = uint32(ptrs & mask31)
-	if ((ptrs >> waitBits) & mask1) == 1 {
-		wait = true
-		return
-	}
-	return
-}
+// initialWindowSize is the receive window both sides assumed before the first window update
+const initialWindowSize = maximumSegmentSize * 30
 
-func (Self *window) pack(maxSize, done uint32, wait bool) uint64 {
-	if wait {
-		return (uint64(1)<<waitBits |
-			uint64(maxSize&mask31)<<dequeueBits) |
-			uint64(done&mask31)
+// maxOffset Set the offset to n if n is larger, the offsets only increase,
+// so the window updates are idempotent and order-insensitive
+func maxOffset(addr *uint64, n uint64) bool {
+	for {
+		old := atomic.LoadUint64(addr)
+		if n <= old {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(addr, old, n) {
+			return true
+		}
 	}
-	return (uint64(0)<<waitBits |
-		uint64(maxSize&mask31)<<dequeueBits) |
-		uint64(done&mask31)
 }
 
 func (Self *window) New() {
@@ -150,115 +246,101 @@ func (Self *window) New() {
 }
 
 func (Self *window) CloseWindow() {
-	if !Self.closeOp {
-		Self.closeOp = true
+	if atomic.CompareAndSwapUint32(&Self.closeOp, 0, 1) {
 		Self.closeOpCh <- struct{}{}
 		Self.closeOpCh <- struct{}{}
 	}
 }
 
+func (Self *window) closed() bool {
+	return atomic.LoadUint32(&Self.closeOp) == 1
+}
+
+const (
+	windowUpdateRatio = 2                     // acknowledge the read size after half of the window consumed
+	windowUpdateDelay = time.Millisecond * 10 // or after the delay, so the small writes not wait for the threshold
+)
+
 type receiveWindow struct {
 	window
-	bufQueue *receiveWindowQueue
-	element  *listElement
-	count    int8
-	bw       *writeBandwidth
-	once     sync.Once
-	// receive window send the current max size and read size to send window
-	// means done size actually store the size receive window has read
+	received       uint64 // absolute offset of the stream data received
+	consumed       uint64 // absolute offset of the stream data read
+	advertised     uint64 // the offset send window allowed to send, consumed plus max size when advertised
+	reported       uint64 // the consumed offset sent to the old peer, it receive the size read since the last update
+	legacy         bool   // the remote side not announced the offset window update, Set at the first update
+	formatOnce     sync.Once
+	maxSize        uint32
+	readBuffer     uint32 // cap of the max size, zero means no cap
+	advertisedSize uint32 // the max size sent to send window
+	delayed        uint32 // a delayed window update is pending
+	bufQueue       *receiveWindowQueue
+	element        *listElement
+	count          int8
+	bw             *writeBandwidth
+	once           sync.Once
+	controller     atomic.Value
+	// receive window send the consumed offset and the max size to send window
 }
 
 func (Self *receiveWindow) New(mux *Mux) {
 	// initial a window for receive
 	Self.bufQueue = newReceiveWindowQueue()
 	Self.element = listEle.Get()
-	Self.maxSizeDone = Self.pack(maximumSegmentSize*30, 0, false)
+	Self.maxSize = initialWindowSize
+	Self.advertisedSize = initialWindowSize
+	Self.advertised = initialWindowSize
 	Self.mux = mux
 	Self.window.New()
 	Self.bw = newWriteBandwidth()
 }
 
-func (Self *receiveWindow) remainingSize(maxSize uint32, delta uint16) (n uint32) {
-	// receive window remaining
-	l := int64(maxSize) - int64(Self.bufQueue.Len())
-	l -= int64(delta)
-	if l > 0 {
-		n = uint32(l)
-	}
-	return
-}
-
 func (Self *receiveWindow) calcSize() {
 	// calculating maximum receive window size
 	if Self.count == 0 {
 		muxBw := Self.mux.bw.Get()
 		connBw := Self.bw.Get()
-		latency := math.Float64frombits(atomic.LoadUint64(&Self.mux.latency))
-		var n uint32
-		if connBw > 0 && muxBw > 0 {
-			if connBw > muxBw {
-				connBw = muxBw
-				Self.bw.GrowRatio()
-			}
-			n = uint32(latency * (muxBw + connBw))
+		if connBw > 0 && muxBw > 0 && connBw > muxBw {
+			connBw = muxBw
+			Self.bw.GrowRatio()
 		}
-		if n < maximumSegmentSize*30 {
-			n = maximumSegmentSize * 30
+		size := atomic.LoadUint32(&Self.maxSize)
+		n := Self.getController().MaxWindow(WindowState{
+			RTT:             Self.mux.rtt.Smoothed(),
+			MuxBandwidth:    muxBw,
+			StreamBandwidth: connBw,
+			Buffered:        Self.bufQueue.Len(),
+			MaxWindow:       size,
+		})
+		if memoryExceeded() && n > size/2 {
+			n = size / 2
+			// the process buffered too much, shrink the window
 		}
-		if n < uint32(float64(maximumSegmentSize*3000)*latency) {
-			// latency gain
-			// if there are some latency more than 10ms will trigger this gain
-			// network pipeline need fill more data that we can measure the max bandwidth
-			n = uint32(float64(maximumSegmentSize*3000) * latency)
+		if n < maximumSegmentSize {
+			n = maximumSegmentSize
 		}
-		for {
-			ptrs := atomic.LoadUint64(&Self.maxSizeDone)
-			size, read, wait := Self.unpack(ptrs)
-			rem := Self.remainingSize(size, 0)
-			ra := float64(rem) / float64(size)
-			if ra > 0.8 {
-				// low fill window gain
-				// if receive window keep low fill, maybe pipeline fill the data, we need a gain
-				// less than 20% fill, gain will trigger
-				n = uint32(float64(n) * 1.5625 * ra * ra)
-			}
-			if n < size/2 {
-				n = size / 2
-				// half reduce
-			}
-			// set the minimal size
-			if n > 2*size {
-				if size == maximumSegmentSize*30 {
-					// we give more ratio when the initial window size, to reduce the time window grow up
-					if n > size*6 {
-						n = size * 6
-					}
-				} else {
-					n = 2 * size
-					// twice grow
-				}
-			}
-			if connBw > 0 && muxBw > 0 {
-				limit := uint32(maximumWindowSize * (connBw / (muxBw + connBw)))
-				if n > limit {
-					log.Println("window too large, calculated:", n, "limit:", limit, connBw, muxBw)
-					n = limit
-				}
-			}
-			// set the maximum size
-			if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(n, read, wait)) {
-				// only change the maxSize
-				break
-			}
+		if n > maximumWindowSize {
+			n = maximumWindowSize
+		}
+		if limit := atomic.LoadUint32(&Self.readBuffer); limit > 0 && n > limit {
+			n = limit
 		}
+		atomic.StoreUint32(&Self.maxSize, n)
+		// only the read session change the max size
 		Self.count = -10
 	}
 	Self.count += 1
 	return
 }
 
+func (Self *receiveWindow) getController() WindowController {
+	if v, ok := Self.controller.Load().(windowControllerValue); ok && v.WindowController != nil {
+		return v.WindowController
+	}
+	return Self.mux.getWindowController()
+}
+
 func (Self *receiveWindow) Write(buf []byte, l uint16, part bool, id int32) (err error) {
-	if Self.closeOp {
+	if Self.closed() {
 		return errors.New("conn.receiveWindow: write on closed window")
 	}
 	element, err := newListElement(buf, l, part)
@@ -266,39 +348,21 @@ func (Self *receiveWindow) Write(buf []byte, l uint16, part bool, id int32) (err
 		return
 	}
 	Self.calcSize() // calculate the max window size
-	var wait bool
-	var maxSize, read uint32
-start:
-	ptrs := atomic.LoadUint64(&Self.maxSizeDone)
-	maxSize, read, wait = Self.unpack(ptrs)
-	remain := Self.remainingSize(maxSize, l)
-	// calculate the remaining window size now, plus the element we will push
-	if remain == 0 && !wait {
-		wait = true
-		if !atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, read, wait)) {
-			// only change the wait status, not send the read size
-			goto start
-			// another goroutine change the status, make sure shall we need wait
-		}
-	} else if !wait {
-		if !atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, 0, wait)) {
-			// reset read size here, and send the read size directly
-			goto start
-			// another goroutine change the status, make sure shall we need wait
-		}
-	} // maybe there are still some data received even if window is full, just keep the wait status
-	// and push into queue. when receive window read enough, send window will be acknowledged.
+	atomic.AddUint64(&Self.received, uint64(l))
+	// maybe there are still some data received even if window is full, the window may shrink,
+	// just push into queue. when receive window read enough, send window will be acknowledged.
 	Self.bufQueue.Push(element)
-	// status check finish, now we can push the element into the queue
-	if !wait {
-		Self.mux.sendInfo(muxMsgSendOk, id, Self.pack(maxSize, read, false))
-		// send the current status to send window
+	Self.mux.addMemory(int64(l))
+	// now we can push the element into the queue
+	if Self.grown() {
+		Self.sendStatus(id, true)
+		// the max size grown, send the current status to send window
 	}
 	return nil
 }
 
 func (Self *receiveWindow) Read(p []byte, id int32) (n int, err error) {
-	if Self.closeOp {
+	if Self.closed() {
 		return 0, io.EOF // receive close signal, returns eof
 	}
 	Self.bw.StartRead()
@@ -311,33 +375,15 @@ func (Self *receiveWindow) readFromQueue(p []byte, id int32) (n int, err error)
 	pOff := 0
 	l := 0
 copyData:
-	if Self.off == uint32(Self.element.L) {
-		// on the first Read method invoked, Self.off and Self.element.l
-		// both zero value
-		listEle.Put(Self.element)
-		if Self.closeOp {
-			return 0, io.EOF
-		}
-		Self.element, err = Self.bufQueue.Pop()
-		// if the queue is empty, Pop method will wait until one element push
-		// into the queue successful, or timeout.
-		// timer start on timeout parameter is set up
-		Self.off = 0
-		if err != nil {
-			Self.CloseWindow() // also close the window, to avoid read twice
-			return             // queue receive stop or time out, break the loop and return
-		}
+	if err = Self.nextElement(); err != nil {
+		return // queue receive stop or time out, break the loop and return
 	}
 	l = copy(p[pOff:], Self.element.Buf[Self.off:Self.element.L])
 	pOff += l
 	Self.off += uint32(l)
 	n += l
 	l = 0
-	if Self.off == uint32(Self.element.L) {
-		windowBuff.Put(Self.element.Buf)
-		Self.sendStatus(id, Self.element.L)
-		// check the window full status
-	}
+	Self.elementRead(id)
 	if pOff < len(p) && Self.element.Part {
 		// element is a part of the segments, trying to fill up buf p
 		goto copyData
@@ -345,43 +391,156 @@ copyData:
 	return // buf p is full or all of segments in buf, return
 }
 
-func (Self *receiveWindow) sendStatus(id int32, l uint16) {
-	var maxSize, read uint32
-	var wait bool
+// nextElement take the next element from the queue if the current one is read up
+func (Self *receiveWindow) nextElement() (err error) {
+	if Self.off != uint32(Self.element.L) {
+		return
+	}
+	// on the first Read method invoked, Self.off and Self.element.l
+	// both zero value
+	listEle.Put(Self.element)
+	if Self.closed() {
+		return io.EOF
+	}
+	Self.element, err = Self.bufQueue.Pop()
+	// if the queue is empty, Pop method will wait until one element push
+	// into the queue successful, or timeout.
+	// timer start on timeout parameter is set up
+	Self.off = 0
+	if err != nil {
+		Self.CloseWindow() // also close the window, to avoid read twice
+		return
+	}
+	Self.mux.addMemory(-int64(Self.element.L))
+	Self.mux.receiveBudget.Consume(uint32(Self.element.L))
+	// the element leave the queue, free up the session window
+	return
+}
+
+// elementRead free up the window if the current element is read up
+func (Self *receiveWindow) elementRead(id int32) {
+	if Self.off == uint32(Self.element.L) {
+		windowBuff.Put(Self.element.Buf)
+		atomic.AddUint64(&Self.consumed, uint64(Self.element.L))
+		Self.sendStatus(id, false)
+		// check the window status
+	}
+}
+
+// WriteTo write the elements to w directly, until the stream closed
+func (Self *receiveWindow) WriteTo(w io.Writer, id int32) (n int64, err error) {
+	var l int
 	for {
-		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
-		maxSize, read, wait = Self.unpack(ptrs)
-		if read <= (read+uint32(l))&mask31 {
-			read += uint32(l)
-			remain := Self.remainingSize(maxSize, 0)
-			if wait && remain > 0 || read >= maxSize/2 || remain == maxSize {
-				if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, 0, false)) {
-					// now we get the current window status success
-					// receive window free up some space we need acknowledge send window, also reset the read size
-					// still having a condition that receive window is empty and not send the status to send window
-					// so send the status here
-					Self.mux.sendInfo(muxMsgSendOk, id, Self.pack(maxSize, read, false))
-					break
-				}
-			} else {
-				if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, read, wait)) {
-					// receive window not into the wait status, or still not having any space now,
-					// just change the read size
-					break
-				}
-			}
-		} else {
-			//overflow
-			if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, uint32(l), wait)) {
-				// reset to l
-				Self.mux.sendInfo(muxMsgSendOk, id, Self.pack(maxSize, read, false))
-				break
+		if Self.closed() {
+			return
+		}
+		Self.bw.StartRead()
+		if err = Self.nextElement(); err != nil {
+			if err == io.EOF {
+				err = nil
 			}
+			return
+		}
+		l, err = w.Write(Self.element.Buf[Self.off:Self.element.L])
+		Self.off += uint32(l)
+		n += int64(l)
+		Self.bw.SetCopySize(uint16(l))
+		Self.elementRead(id)
+		if err != nil {
+			return
 		}
-		runtime.Gosched()
-		// another goroutine change remaining or wait status, make sure
 	}
-	return
+}
+
+// messageEnd reports whether the last element read is the end of a message
+func (Self *receiveWindow) messageEnd() bool {
+	return Self.off == uint32(Self.element.L) && !Self.element.Part
+}
+
+// sendStatus advertise the consumed offset and the max size, send window can send until the sum of them.
+// the update is sent when half of the window free up, or the send window used up the window,
+// otherwise it is delayed and coalesced with the following ones.
+func (Self *receiveWindow) sendStatus(id int32, force bool) {
+	for {
+		consumed := atomic.LoadUint64(&Self.consumed)
+		maxSize := atomic.LoadUint32(&Self.maxSize)
+		limit := consumed + uint64(maxSize)
+		advertised := atomic.LoadUint64(&Self.advertised)
+		if limit <= advertised {
+			return // the window shrink, wait for more data consumed
+		}
+		if !force && limit-advertised < uint64(maxSize/windowUpdateRatio) &&
+			atomic.LoadUint64(&Self.received) < advertised {
+			// not free up enough space, and send window is not waiting, acknowledge it later
+			Self.delayStatus(id)
+			return
+		}
+		if atomic.CompareAndSwapUint64(&Self.advertised, advertised, limit) {
+			atomic.StoreUint32(&Self.advertisedSize, maxSize)
+			Self.advertise(id, consumed, maxSize)
+			Self.mux.traceWindow(id, true, limit, maxSize)
+			return
+		}
+		// another goroutine advertised, make sure
+	}
+}
+
+// Readvertise send the current status to send window again, the send window asked for it.
+// the advertised offset never goes back, even if the window shrink
+func (Self *receiveWindow) Readvertise(id int32) {
+	consumed := atomic.LoadUint64(&Self.consumed)
+	maxSize := atomic.LoadUint32(&Self.maxSize)
+	maxOffset(&Self.advertised, consumed+uint64(maxSize))
+	if advertised := atomic.LoadUint64(&Self.advertised); advertised > consumed+uint64(maxSize) {
+		maxSize = uint32(advertised - consumed)
+	}
+	Self.advertise(id, consumed, maxSize)
+}
+
+// advertise send the window update, the old peers receive the size read since the last update instead of the offset
+func (Self *receiveWindow) advertise(id int32, consumed uint64, maxSize uint32) {
+	Self.formatOnce.Do(func() {
+		// the capabilities is the first frame the remote side sent, it is received before the stream data,
+		// the format never change in the stream, the old format carry the size, not the offset
+		Self.legacy = !Self.mux.remoteCapable(capWindowOffset)
+	})
+	if !Self.legacy {
+		Self.mux.sendInfo(muxWindowUpdate, id, windowUpdate{offset: consumed, size: maxSize})
+		return
+	}
+	var read uint32
+	for {
+		reported := atomic.LoadUint64(&Self.reported)
+		if consumed <= reported {
+			break // another goroutine reported the larger offset
+		}
+		if atomic.CompareAndSwapUint64(&Self.reported, reported, consumed) {
+			read = uint32(consumed - reported)
+			break
+		}
+	}
+	Self.mux.sendInfo(muxMsgSendOk, id, packLegacyWindow(maxSize, read))
+}
+
+// grown reports whether the max size grown enough to acknowledge the send window immediately,
+// the smaller changes are sent with the consumed offset
+func (Self *receiveWindow) grown() bool {
+	advertised := atomic.LoadUint32(&Self.advertisedSize)
+	return atomic.LoadUint32(&Self.maxSize) > advertised+advertised/windowUpdateRatio
+}
+
+// delayStatus acknowledge the consumed offset below the threshold after a short delay,
+// the updates of the following reads are coalesced into one frame
+func (Self *receiveWindow) delayStatus(id int32) {
+	if !atomic.CompareAndSwapUint32(&Self.delayed, 0, 1) {
+		return
+	}
+	time.AfterFunc(windowUpdateDelay, func() {
+		atomic.StoreUint32(&Self.delayed, 0)
+		if !Self.closed() {
+			Self.sendStatus(id, true)
+		}
+	})
 }
 
 func (Self *receiveWindow) SetTimeOut(t time.Time) {
@@ -415,140 +574,110 @@ func (Self *receiveWindow) release() {
 		if ele.Buf != nil {
 			windowBuff.Put(ele.Buf)
 		}
+		Self.mux.addMemory(-int64(ele.L))
+		Self.mux.receiveBudget.Consume(uint32(ele.L))
 		listEle.Put(ele)
 	} // release resource
 }
 
 type sendWindow struct {
+	// the 64 bits fields accessed by atomics are first for the alignment on the 32 bits platforms
+	sent    uint64 // absolute offset of the stream data sent
+	limit   uint64 // the offset receive window allowed to send
+	acked   uint64 // the offset receive window consumed
+	blocked int64  // nanoseconds the writer waited for the window
 	window
-	buf       []byte
-	setSizeCh chan struct{}
-	timeout   time.Time
-	// send window receive the receive window max size and read size
-	// done size store the size send window has send, send and read will be totally equal
-	// so send minus read, send window can get the current window size remaining
-}
-
-func (Self *sendWindow) New(mux *Mux) {
-	Self.setSizeCh = make(chan struct{})
-	Self.maxSizeDone = Self.pack(maximumSegmentSize*30, 0, false)
+	id          int32
+	writeBuffer uint32 // cap of the bytes not acknowledged, zero means no cap
+	priority    uint32
+	buf         []byte
+	setSizeCh   chan struct{}
+	timeout     time.Time
+	// send window receive the consumed offset and max size of the receive window,
+	// send window can send until the sum of them
+}
+
+func (Self *sendWindow) New(mux *Mux, id int32) {
+	Self.id = id
+	Self.setSizeCh = make(chan struct{}, 1)
+	Self.priority = uint32(PriorityNormal)
+	Self.limit = initialWindowSize
 	Self.mux = mux
 	Self.window.New()
 }
 
+func (Self *sendWindow) Priority() uint8 {
+	return uint8(atomic.LoadUint32(&Self.priority))
+}
+
 func (Self *sendWindow) SetSendBuf(buf []byte) {
 	// send window buff from conn write method, set it to send window
 	Self.buf = buf
 	Self.off = 0
 }
 
-func (Self *sendWindow) remainingSize(maxSize, send uint32) uint32 {
-	l := int64(maxSize&mask31) - int64(send&mask31)
-	if l > 0 {
-		return uint32(l)
-	}
-	return 0
-}
-
-func (Self *sendWindow) SetSize(currentMaxSizeDone uint64) (closed bool) {
-	// set the window size from receive window
-	defer func() {
-		if recover() != nil {
-			closed = true
+func (Self *sendWindow) remainingSize() uint32 {
+	sent := atomic.LoadUint64(&Self.sent)
+	limit := atomic.LoadUint64(&Self.limit)
+	if n := atomic.LoadUint32(&Self.writeBuffer); n > 0 {
+		if acked := atomic.LoadUint64(&Self.acked) + uint64(n); acked < limit {
+			limit = acked
 		}
-	}()
-	if Self.closeOp {
-		close(Self.setSizeCh)
-		return true
 	}
-	var maxsize, send uint32
-	var wait, newWait bool
-	currentMaxSize, read, _ := Self.unpack(currentMaxSizeDone)
-	for {
-		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
-		maxsize, send, wait = Self.unpack(ptrs)
-		if read > send {
-			log.Println("window read > send: max size:", currentMaxSize, "read:", read, "send", send)
-			return
-		}
-		if read == 0 && currentMaxSize == maxsize {
-			return
-		}
-		send -= read
-		remain := Self.remainingSize(currentMaxSize, send)
-		if remain == 0 && wait {
-			// just keep the wait status
-			newWait = true
-		}
-		// remain > 0, change wait to false. or remain == 0, wait is false, just keep it
-		if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(currentMaxSize, send, newWait)) {
-			//log.Printf("currentMaxSize:%d read:%d send:%d", currentMaxSize, read, send)
-			break
-		}
-		// anther goroutine change wait status or window size
+	if limit <= sent {
+		return 0
 	}
-	if wait && !newWait {
-		// send window into the wait status, need notice the channel
-		Self.allow()
+	if limit-sent > math.MaxUint32 {
+		return math.MaxUint32
 	}
-	// send window not into the wait status, so just do slide
-	return false
+	return uint32(limit - sent)
 }
 
-func (Self *sendWindow) allow() {
-	select {
-	case Self.setSizeCh <- struct{}{}:
-		return
-	case <-Self.closeOpCh:
-		close(Self.setSizeCh)
+// SetLegacySize Set the window from the update of the old peers, the read size is added to the offset acknowledged,
+// the updates are in order, only the read session call it
+func (Self *sendWindow) SetLegacySize(maxSize, read uint32) {
+	Self.SetSize(atomic.LoadUint64(&Self.acked)+uint64(read), maxSize)
+}
+
+// SetSize Set the window from the receive window update, the update may be duplicated or out of order,
+// only the larger offsets take effect
+func (Self *sendWindow) SetSize(offset uint64, size uint32) {
+	if Self.closed() {
 		return
 	}
+	acked := maxOffset(&Self.acked, offset)
+	if maxOffset(&Self.limit, offset+uint64(size)) || acked {
+		Self.notify()
+		Self.mux.traceWindow(Self.id, false, atomic.LoadUint64(&Self.limit), size)
+	}
 }
 
-func (Self *sendWindow) sent(sentSize uint32) {
-	var maxSie, send uint32
-	var wait bool
-	for {
-		ptrs := atomic.LoadUint64(&Self.maxSizeDone)
-		maxSie, send, wait = Self.unpack(ptrs)
-		if (send+sentSize)&mask31 < send {
-			// overflow
-			runtime.Gosched()
-			continue
-		}
-		if atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSie, send+sentSize, wait)) {
-			// set the send size
-			break
-		}
+func (Self *sendWindow) notify() {
+	select {
+	case Self.setSizeCh <- struct{}{}:
+	default:
+		// already noticed, the writer will check the window again
 	}
 }
 
 func (Self *sendWindow) WriteTo() (p []byte, sendSize uint32, part bool, err error) {
 	// returns buf segments, return only one segments, need a loop outside
 	// until err = io.EOF
-	if Self.closeOp {
+	if Self.closed() {
 		return nil, 0, false, errors.New("conn.writeWindow: window closed")
 	}
 	if Self.off == uint32(len(Self.buf)) {
 		return nil, 0, false, io.EOF
 		// send window buff is drain, return eof and get another one
 	}
-	var maxSize, send uint32
-start:
-	ptrs := atomic.LoadUint64(&Self.maxSizeDone)
-	maxSize, send, _ = Self.unpack(ptrs)
-	remain := Self.remainingSize(maxSize, send)
-	if remain == 0 {
-		if !atomic.CompareAndSwapUint64(&Self.maxSizeDone, ptrs, Self.pack(maxSize, send, true)) {
-			// just change the status wait status
-			goto start // another goroutine change the window, try again
-		}
+	remain := Self.remainingSize()
+	for remain == 0 {
 		// into the wait status
 		err = Self.waitReceiveWindow()
 		if err != nil {
 			return nil, 0, false, err
 		}
-		goto start
+		remain = Self.remainingSize()
 	}
 	// there are still remaining window
 	if len(Self.buf[Self.off:]) > maximumSegmentSize {
@@ -561,42 +690,67 @@ start:
 		// window MAXIMUM_SEGMENT_SIZE or send buf left
 		sendSize = remain
 	}
+	sendSize, err = Self.mux.sendBudget.Acquire(sendSize, Self.timeout, Self.closeOpCh, Self.mux.closeChan)
+	if err != nil {
+		// the session window is shared by all streams, wait for it
+		return nil, 0, false, err
+	}
 	if sendSize < uint32(len(Self.buf[Self.off:])) {
 		part = true
 	}
 	p = Self.buf[Self.off : sendSize+Self.off]
 	Self.off += sendSize
-	Self.sent(sendSize)
+	atomic.AddUint64(&Self.sent, uint64(sendSize))
+	return
+}
+
+// sendSegment send the buffer from windowBuff as a frame without copy if the windows allow it now,
+// otherwise send it as Write. the buffer is owned by sendSegment
+func (Self *sendWindow) sendSegment(buf []byte, id int32) (err error) {
+	l := uint32(len(buf))
+	if !Self.closed() && Self.remainingSize() >= l && Self.mux.sendBudget.TryAcquire(l) {
+		atomic.AddUint64(&Self.sent, uint64(l))
+		Self.mux.sendContent(muxNewMsg, id, Self.Priority(), buf)
+		return
+	}
+	_, err = Self.WriteFull(buf, id)
+	windowBuff.Put(buf)
 	return
 }
 
 func (Self *sendWindow) waitReceiveWindow() (err error) {
-	t := Self.timeout.Sub(time.Now())
-	if t < 0 { // not set the timeout, wait for it as long as connection close
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&Self.blocked, int64(time.Since(start)))
+	}()
+	var timeoutCh <-chan time.Time
+	t := Self.timeout.Sub(start)
+	if t >= 0 { // otherwise not set the timeout, wait for it as long as connection close
+		timer := time.NewTimer(t)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	interval := Self.mux.probeInterval()
+	probe := time.NewTimer(interval)
+	defer probe.Stop()
+	// waiting for receive usable window size, or timeout
+	for {
 		select {
-		case _, ok := <-Self.setSizeCh:
-			if !ok {
-				return errors.New("conn.writeWindow: window closed")
-			}
+		case <-Self.setSizeCh:
 			return nil
+		case <-timeoutCh:
+			return errors.New("conn.writeWindow: write to time out")
 		case <-Self.closeOpCh:
 			return errors.New("conn.writeWindow: window closed")
+		case <-Self.mux.closeChan:
+			return errors.New("the mux has closed")
+		case <-probe.C:
+			// no window update for a while, maybe lost, ask receive window for the current status
+			Self.mux.sendInfo(muxWindowProbe, Self.id, nil)
+			interval = nextProbeInterval(interval)
+			probe.Reset(interval)
 		}
 	}
-	timer := time.NewTimer(t)
-	defer timer.Stop()
-	// waiting for receive usable window size, or timeout
-	select {
-	case _, ok := <-Self.setSizeCh:
-		if !ok {
-			return errors.New("conn.writeWindow: window closed")
-		}
-		return nil
-	case <-timer.C:
-		return errors.New("conn.writeWindow: write to time out")
-	case <-Self.closeOpCh:
-		return errors.New("conn.writeWindow: window closed")
-	}
 }
 
 func (Self *sendWindow) WriteFull(buf []byte, id int32) (n int, err error) {
@@ -618,9 +772,9 @@ func (Self *sendWindow) WriteFull(buf []byte, id int32) (n int, err error) {
 		n += int(l)
 		l = 0
 		if part {
-			Self.mux.sendInfo(muxNewMsgPart, id, bufSeg)
+			Self.mux.sendPriorityInfo(muxNewMsgPart, id, Self.Priority(), bufSeg)
 		} else {
-			Self.mux.sendInfo(muxNewMsg, id, bufSeg)
+			Self.mux.sendPriorityInfo(muxNewMsg, id, Self.Priority(), bufSeg)
 		}
 		// send to other side, not send nil data to other side
 	}
@@ -630,6 +784,7 @@ func (Self *sendWindow) WriteFull(buf []byte, id int32) (n int, err error) {
 func (Self *sendWindow) SetTimeOut(t time.Time) {
 	// waiting for receive a receive window size
 	Self.timeout = t
+	Self.notify() // the writer waiting for the window apply the new deadline
 }
 
 type writeBandwidth struct {
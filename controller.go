@@ -0,0 +1,111 @@
+package nps_mux
+
+import (
+	"log"
+	"time"
+)
+
+// WindowState is the receive window status when the window size is calculated
+type WindowState struct {
+	RTT             time.Duration // latency of the mux connection
+	MuxBandwidth    float64       // bytes per second the mux connection receive, zero if unknown
+	StreamBandwidth float64       // bytes per second the stream is read, zero if unknown
+	Buffered        uint32        // bytes waiting in the receive queue
+	MaxWindow       uint32        // current max window size
+}
+
+// WindowController calculate the max receive window size of the stream,
+// the result is limited between one segment and maximumWindowSize.
+// MaxWindow is called on the read session, so it must not block.
+type WindowController interface {
+	MaxWindow(state WindowState) uint32
+}
+
+// AdaptiveWindow is the default WindowController, it grow the window with the latency and bandwidth,
+// and share the maximum window between the streams by their read bandwidth
+type AdaptiveWindow struct{}
+
+func (AdaptiveWindow) MaxWindow(state WindowState) uint32 {
+	latency := state.RTT.Seconds()
+	muxBw, connBw := state.MuxBandwidth, state.StreamBandwidth
+	var n uint32
+	if connBw > 0 && muxBw > 0 {
+		n = uint32(latency * (muxBw + connBw))
+	}
+	if n < maximumSegmentSize*30 {
+		n = maximumSegmentSize * 30
+	}
+	if n < uint32(float64(maximumSegmentSize*3000)*latency) {
+		// latency gain
+		// if there are some latency more than 10ms will trigger this gain
+		// network pipeline need fill more data that we can measure the max bandwidth
+		n = uint32(float64(maximumSegmentSize*3000) * latency)
+	}
+	size := state.MaxWindow
+	var rem uint32
+	if size > state.Buffered {
+		rem = size - state.Buffered
+	}
+	ra := float64(rem) / float64(size)
+	if ra > 0.8 {
+		// low fill window gain
+		// if receive window keep low fill, maybe pipeline fill the data, we need a gain
+		// less than 20% fill, gain will trigger
+		n = uint32(float64(n) * 1.5625 * ra * ra)
+	}
+	if n < size/2 {
+		n = size / 2
+		// half reduce
+	}
+	// set the minimal size
+	if n > 2*size {
+		if size == maximumSegmentSize*30 {
+			// we give more ratio when the initial window size, to reduce the time window grow up
+			if n > size*6 {
+				n = size * 6
+			}
+		} else {
+			n = 2 * size
+			// twice grow
+		}
+	}
+	if connBw > 0 && muxBw > 0 {
+		limit := uint32(maximumWindowSize * (connBw / (muxBw + connBw)))
+		if n > limit {
+			log.Println("window too large, calculated:", n, "limit:", limit, connBw, muxBw)
+			n = limit
+		}
+	}
+	// set the maximum size
+	return n
+}
+
+// FixedWindow is a WindowController always use the same window size,
+// e.g. a large one for the satellite link, or a small one to save memory on LAN
+type FixedWindow uint32
+
+func (s FixedWindow) MaxWindow(state WindowState) uint32 {
+	return uint32(s)
+}
+
+type windowControllerValue struct {
+	WindowController
+}
+
+// SetWindowController Set the WindowController of all the streams which not Set their own,
+// nil means use the AdaptiveWindow
+func (s *Mux) SetWindowController(controller WindowController) {
+	s.windowController.Store(windowControllerValue{controller})
+}
+
+func (s *Mux) getWindowController() WindowController {
+	if v, ok := s.windowController.Load().(windowControllerValue); ok && v.WindowController != nil {
+		return v.WindowController
+	}
+	return AdaptiveWindow{}
+}
+
+// SetWindowController Set the WindowController of the stream, nil means use the mux one
+func (s *conn) SetWindowController(controller WindowController) {
+	s.receiveWindow.controller.Store(windowControllerValue{controller})
+}
@@ -0,0 +1,66 @@
+package nps_mux
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	maximumDatagramSize = maximumSegmentSize      // datagram is never fragmented
+	datagramQueueSize   = 256                     // received datagrams waiting for ReadDatagram
+	datagramQueueLimit  = maximumSegmentSize * 64 // queued data length, more than this the write queue is congested
+)
+
+type datagram struct {
+	flow int32
+	buf  []byte
+}
+
+// SendDatagram send an unreliable datagram to the remote side, the flow id is passed to ReadDatagram as it is.
+// datagram doesn't use stream window, and it is dropped silently while the write queue is congested,
+// or before the first frame of the remote side received, it returns ErrNotSupported if the remote side doesn't support it.
+func (s *Mux) SendDatagram(flow int32, p []byte) error {
+	if len(p) == 0 || len(p) > maximumDatagramSize {
+		return errors.New("mux: datagram length out of range")
+	}
+	if s.IsClose {
+		return errors.New("the mux has closed")
+	}
+	if !s.remoteCapable(capDatagram) {
+		if s.capabilitiesReceived() {
+			return ErrNotSupported
+			// the old peers can't skip the content of the unknown frames
+		}
+		atomic.AddUint64(&s.datagramDropped, 1)
+		return nil
+	}
+	if s.writeQueue.Len() > datagramQueueLimit {
+		atomic.AddUint64(&s.datagramDropped, 1)
+		return nil
+	}
+	s.sendInfo(muxDatagram, flow, p)
+	return nil
+}
+
+// ReadDatagram returns the next datagram sent by the remote side and the flow id it tagged.
+// datagrams are dropped if they are not read in time.
+func (s *Mux) ReadDatagram() (flow int32, p []byte, err error) {
+	d, ok := <-s.datagramCh
+	if !ok {
+		return 0, nil, errors.New("the mux has closed")
+	}
+	return d.flow, d.buf, nil
+}
+
+func (s *Mux) newDatagram(pack *muxPackager) {
+	d := datagram{flow: pack.id, buf: make([]byte, pack.length)}
+	copy(d.buf, pack.content[:pack.length])
+	windowBuff.Put(pack.content)
+	muxPack.Put(pack)
+	select {
+	case s.datagramCh <- d:
+	default:
+		atomic.AddUint64(&s.datagramDropped, 1)
+		// nobody read it, just like udp drop it
+	}
+}
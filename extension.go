@@ -0,0 +1,108 @@
+package nps_mux
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// the flags from ExtensionFlagMin to ExtensionFlagMax are reserved for user-defined frames,
+// the mux itself never use them
+const (
+	ExtensionFlagMin uint8 = 0x80
+	ExtensionFlagMax uint8 = 0xff
+)
+
+// FrameHandler handle an extension frame received from the remote side.
+// it is invoked in the read session, so it must not block,
+// and payload must not be retained after the handler returns.
+type FrameHandler func(streamID int32, payload []byte)
+
+type frameRegistry struct {
+	remote   [4]uint32 // bitmap of the extension flags which remote side has a handler
+	handlers map[uint8]FrameHandler
+	sync.RWMutex
+}
+
+func newFrameRegistry() *frameRegistry {
+	return &frameRegistry{
+		handlers: make(map[uint8]FrameHandler),
+	}
+}
+
+func (s *frameRegistry) Get(flag uint8) (handler FrameHandler, ok bool) {
+	s.RLock()
+	handler, ok = s.handlers[flag]
+	s.RUnlock()
+	return
+}
+
+func (s *frameRegistry) Set(flag uint8, handler FrameHandler) {
+	s.Lock()
+	if handler == nil {
+		delete(s.handlers, flag)
+	} else {
+		s.handlers[flag] = handler
+	}
+	s.Unlock()
+}
+
+func (s *frameRegistry) SetRemote(flag uint8) {
+	idx := flag - ExtensionFlagMin
+	for {
+		old := atomic.LoadUint32(&s.remote[idx/32])
+		if atomic.CompareAndSwapUint32(&s.remote[idx/32], old, old|1<<(idx%32)) {
+			return
+		}
+	}
+}
+
+func (s *frameRegistry) Remote(flag uint8) bool {
+	idx := flag - ExtensionFlagMin
+	return atomic.LoadUint32(&s.remote[idx/32])&(1<<(idx%32)) != 0
+}
+
+// RegisterFrameHandler Set the handler of the user-defined frame flag, and announce it to the remote side.
+// remote side only send the frame after it receive the announcement,
+// a nil handler remove the registered one, frames received later are dropped.
+func (s *Mux) RegisterFrameHandler(flag uint8, handler FrameHandler) error {
+	if flag < ExtensionFlagMin {
+		return errors.New("mux: frame flag out of the extension range")
+	}
+	if s.IsClose {
+		return errors.New("the mux has closed")
+	}
+	s.frames.Set(flag, handler)
+	if handler != nil {
+		s.sendInfo(muxFrameRegister, int32(flag), nil)
+		// announce frame is a header only frame, peers don't know it just drop the header
+	}
+	return nil
+}
+
+// SendFrame send a user-defined frame to the remote side, streamID is passed to the remote handler as it is.
+// it returns an error if the remote side has not registered a handler for the flag.
+func (s *Mux) SendFrame(flag uint8, streamID int32, payload []byte) error {
+	if flag < ExtensionFlagMin {
+		return errors.New("mux: frame flag out of the extension range")
+	}
+	if len(payload) == 0 || len(payload) > maximumSegmentSize {
+		return errors.New("mux: frame payload length out of range")
+	}
+	if s.IsClose {
+		return errors.New("the mux has closed")
+	}
+	if !s.frames.Remote(flag) {
+		return errors.New("mux: remote side has no handler for the frame flag")
+	}
+	s.sendInfo(flag, streamID, payload)
+	return nil
+}
+
+func (s *Mux) handleFrame(pack *muxPackager) {
+	if handler, ok := s.frames.Get(pack.flag); ok {
+		handler(pack.id, pack.content)
+	}
+	windowBuff.Put(pack.content)
+	muxPack.Put(pack)
+}
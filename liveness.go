@@ -0,0 +1,107 @@
+package nps_mux
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+const defaultLivenessFloor = time.Second * 5
+
+// DeadPeerHandler is called when nothing received from the remote side within the liveness timeout after a probe,
+// idle is how long since the last frame received. the mux is closed after it returns.
+type DeadPeerHandler func(idle time.Duration)
+
+type deadPeerHandlerValue struct {
+	DeadPeerHandler
+}
+
+// SetLivenessTimeout Set the bounds of the liveness timeout.
+// the timeout is srtt + 4 * rttvar like the TCP retransmission timer, no less than floor, and no more than ceiling,
+// the ceiling is also used before the RTT measured. the ceiling default to pingCheckThreshold * 5 seconds.
+func (s *Mux) SetLivenessTimeout(floor, ceiling time.Duration) {
+	if floor <= 0 {
+		floor = defaultLivenessFloor
+	}
+	if ceiling < floor {
+		ceiling = floor
+	}
+	atomic.StoreInt64(&s.pinger.floor, int64(floor))
+	atomic.StoreInt64(&s.pinger.ceiling, int64(ceiling))
+}
+
+// SetDeadPeerHandler Set the function called when the remote side is suspected dead, e.g. switch to another server
+func (s *Mux) SetDeadPeerHandler(handler DeadPeerHandler) {
+	s.deadPeerHandler.Store(deadPeerHandlerValue{handler})
+}
+
+func (s *Mux) livenessTimeout() time.Duration {
+	floor := time.Duration(atomic.LoadInt64(&s.pinger.floor))
+	ceiling := time.Duration(atomic.LoadInt64(&s.pinger.ceiling))
+	stats := s.rtt.Stats()
+	if stats.Smoothed == 0 {
+		return ceiling // not measured yet
+	}
+	timeout := stats.Smoothed + 4*stats.Variance
+	if timeout < floor {
+		timeout = floor
+	}
+	if timeout > ceiling {
+		timeout = ceiling
+	}
+	return timeout
+}
+
+// checkLiveness is armed when a probe sent, any frame received after that proves the remote side alive.
+// only the earliest deadline is pending, the later probes are covered by the earlier deadline,
+// unless the RTT measured shorten the timeout.
+func (s *Mux) checkLiveness() {
+	timeout := s.livenessTimeout()
+	now := time.Now()
+	s.pinger.Lock()
+	defer s.pinger.Unlock()
+	if s.pinger.timer != nil && !now.Add(timeout).Before(s.pinger.deadline) {
+		return
+	}
+	if s.pinger.timer != nil {
+		s.pinger.timer.Stop()
+	}
+	s.pinger.deadline = now.Add(timeout)
+	var timer *time.Timer
+	timer = time.AfterFunc(timeout, func() {
+		s.pinger.Lock()
+		if s.pinger.timer != timer {
+			s.pinger.Unlock()
+			return // replaced by an earlier deadline
+		}
+		s.pinger.timer = nil
+		s.pinger.Unlock()
+		s.livenessExpired(now.UnixNano())
+	})
+	s.pinger.timer = timer
+}
+
+func (s *Mux) livenessExpired(sent int64) {
+	if s.IsClose {
+		return
+	}
+	lastRecv := atomic.LoadInt64(&s.pinger.lastRecv)
+	if lastRecv >= sent {
+		return
+	}
+	idle := time.Duration(time.Now().UnixNano() - lastRecv)
+	log.Println("mux: remote side not respond, idle", idle)
+	if v, ok := s.deadPeerHandler.Load().(deadPeerHandlerValue); ok && v.DeadPeerHandler != nil {
+		v.DeadPeerHandler(idle)
+	}
+	_ = s.Close()
+}
+
+func (Self *pinger) stop() {
+	Self.Lock()
+	if Self.timer != nil {
+		Self.timer.Stop()
+		Self.timer = nil
+	}
+	Self.Unlock()
+}
@@ -2,9 +2,11 @@ package nps_mux
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 type connMap struct {
+	size int64 // read it atomic without the lock
 	cMap map[int32]*conn
 	//closeCh chan struct{}
 	sync.RWMutex
@@ -17,11 +19,8 @@ func NewConnMap() *connMap {
 	return cMap
 }
 
-func (s *connMap) Size() (n int) {
-	s.RLock()
-	n = len(s.cMap)
-	s.RUnlock()
-	return
+func (s *connMap) Size() int64 {
+	return atomic.LoadInt64(&s.size)
 }
 
 func (s *connMap) Get(id int32) (*conn, bool) {
@@ -36,6 +35,9 @@ func (s *connMap) Get(id int32) (*conn, bool) {
 
 func (s *connMap) Set(id int32, v *conn) {
 	s.Lock()
+	if _, ok := s.cMap[id]; !ok {
+		atomic.AddInt64(&s.size, 1)
+	}
 	s.cMap[id] = v
 	s.Unlock()
 }
@@ -48,6 +50,9 @@ func (s *connMap) Close() {
 
 func (s *connMap) Delete(id int32) {
 	s.Lock()
+	if _, ok := s.cMap[id]; ok {
+		atomic.AddInt64(&s.size, -1)
+	}
 	delete(s.cMap, id)
 	s.Unlock()
 }
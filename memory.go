@@ -0,0 +1,66 @@
+package nps_mux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	memoryWaitStep = time.Millisecond * 10
+	memoryMaxWait  = time.Millisecond * 100 // the longest delay before reading a frame, keep the ping alive
+)
+
+var memory struct {
+	used  int64 // bytes buffered by all the muxes
+	limit int64 // zero means no limit
+}
+
+// MemoryStats is the buffer usage of the process
+type MemoryStats struct {
+	Buffered int64  // bytes buffered in the receive windows and write queues of all the muxes
+	Limit    int64  // the limit Set by SetMemoryLimit, zero means no limit
+	PoolGets uint64 // window buffers taken from the pool
+	PoolPuts uint64 // window buffers returned to the pool
+}
+
+// SetMemoryLimit Set the bytes can be buffered by all the muxes of the process, zero means no limit.
+// it's a soft limit, when exceeded, receive windows shrink and the muxes holding buffers delay reading from the connection.
+func SetMemoryLimit(n int64) {
+	atomic.StoreInt64(&memory.limit, n)
+}
+
+// Memory returns the buffer usage of all the muxes
+func Memory() MemoryStats {
+	return MemoryStats{
+		Buffered: atomic.LoadInt64(&memory.used),
+		Limit:    atomic.LoadInt64(&memory.limit),
+		PoolGets: atomic.LoadUint64(&windowBuff.gets),
+		PoolPuts: atomic.LoadUint64(&windowBuff.puts),
+	}
+}
+
+func memoryExceeded() bool {
+	limit := atomic.LoadInt64(&memory.limit)
+	return limit > 0 && atomic.LoadInt64(&memory.used) > limit
+}
+
+// MemoryUsage returns the bytes buffered in the receive windows and write queue of the mux
+func (s *Mux) MemoryUsage() int64 {
+	return atomic.LoadInt64(&s.memory)
+}
+
+func (s *Mux) addMemory(n int64) {
+	atomic.AddInt64(&s.memory, n)
+	atomic.AddInt64(&memory.used, n)
+}
+
+// waitMemory delay reading the next frame while the process buffered too much,
+// only the muxes holding buffers wait, the remote side is slowed down by the connection
+func (s *Mux) waitMemory() {
+	for wait := time.Duration(0); wait < memoryMaxWait && memoryExceeded(); wait += memoryWaitStep {
+		if s.IsClose || atomic.LoadInt64(&s.memory) <= 0 {
+			return
+		}
+		time.Sleep(memoryWaitStep)
+	}
+}
@@ -0,0 +1,133 @@
+package nps_mux
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync/atomic"
+)
+
+const (
+	messageQueueSize   = 64 // session message frames can be sent and not read by the remote application
+	maximumMessageSize = maximumSegmentSize * messageQueueSize
+)
+
+// sessionMsg is a message received and the number of its frames, they are acknowledged after it is read
+type sessionMsg struct {
+	buf    []byte
+	frames int32
+}
+
+// SendMessage send a message to the remote side out of band,
+// it doesn't use any stream id or window, and the remote side receive exactly the same message from Messages.
+// it waits for the first frame of the remote side to know whether it supports the messages, ErrNotSupported if not.
+// it blocks while too many messages are not read by the remote side, until ctx done.
+func (s *Mux) SendMessage(ctx context.Context, msg []byte) (err error) {
+	if len(msg) == 0 || len(msg) > maximumMessageSize {
+		return errors.New("mux: message length out of range")
+	}
+	if s.IsClose {
+		return errors.New("the mux has closed")
+	}
+	if err = s.waitCapabilities(ctx); err != nil {
+		return
+	}
+	if !s.remoteCapable(capSessionMessage) {
+		return ErrNotSupported
+		// the old peers can't skip the content of the unknown frames
+	}
+	n := (len(msg) + maximumSegmentSize - 1) / maximumSegmentSize
+	s.msgLock.Lock()
+	defer s.msgLock.Unlock()
+	// the frames of one message must be queued together
+	for i := 0; i < n; i++ {
+		select {
+		case s.msgSlots <- struct{}{}:
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-s.closeChan:
+			err = errors.New("the mux has closed")
+		}
+		if err != nil {
+			for ; i > 0; i-- {
+				<-s.msgSlots
+			}
+			// nothing queued, give back the slots
+			return
+		}
+	}
+	// now we get enough slots, queue the whole message
+	for len(msg) > maximumSegmentSize {
+		s.sendInfo(muxSessionMsgPart, 0, msg[:maximumSegmentSize])
+		msg = msg[maximumSegmentSize:]
+	}
+	s.sendInfo(muxSessionMsg, 0, msg)
+	return
+}
+
+// Messages returns the channel of the messages sent by the remote side SendMessage,
+// the channel is closed when the mux closed, the messages not read yet are dropped.
+// the remote side SendMessage blocks while it is not read, the streams are not affected.
+func (s *Mux) Messages() <-chan []byte {
+	return s.msgCh
+}
+
+// deliverMessages hand the messages received to the application,
+// the remote side can send more after they are read
+func (s *Mux) deliverMessages() {
+	defer close(s.msgCh)
+	for msg := range s.msgQueue {
+		select {
+		case s.msgCh <- msg.buf:
+			s.sendInfo(muxSessionMsgRead, msg.frames, nil)
+		case <-s.closeChan:
+			return
+		}
+	}
+}
+
+// sessionMsgRead give back the slots of the message frames the remote application read
+func (s *Mux) sessionMsgRead(frames int32) {
+	for ; frames > 0; frames-- {
+		select {
+		case <-s.msgSlots:
+		default:
+			return // more than sent, the remote side is broken
+		}
+	}
+}
+
+func (s *Mux) newSessionMsg(pack *muxPackager) {
+	s.msgFrames++
+	if len(s.msgBuf)+int(pack.length) > maximumMessageSize {
+		log.Println("mux: session message too large, dropped")
+		if !s.msgDrop {
+			atomic.AddUint64(&s.msgDropped, 1)
+		}
+		s.msgDrop = true
+	}
+	if !s.msgDrop {
+		s.msgBuf = append(s.msgBuf, pack.content[:pack.length]...)
+	}
+	windowBuff.Put(pack.content)
+	if pack.flag == muxSessionMsg {
+		msg := sessionMsg{buf: s.msgBuf, frames: s.msgFrames}
+		drop := s.msgDrop
+		s.msgBuf, s.msgDrop, s.msgFrames = nil, false, 0
+		// the last frame of the message, Set to receive a new one
+		if !drop {
+			select {
+			case s.msgQueue <- msg:
+			default:
+				// the remote side sent more than the slots, the read session must not wait for the application
+				atomic.AddUint64(&s.msgDropped, 1)
+				drop = true
+			}
+		}
+		if drop {
+			s.sendInfo(muxSessionMsgRead, msg.frames, nil)
+			// acknowledged as read, the remote side never lose the slots
+		}
+	}
+	muxPack.Put(pack)
+}
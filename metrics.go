@@ -0,0 +1,286 @@
+package nps_mux
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsRegistry collect the stats of the registered muxes, and serve them in the Prometheus text format.
+// the aggregate metrics cover all the muxes, the per-mux metrics are labeled by the name registered,
+// the muxes registered without a name are only counted in the aggregate, so thousands of muxes don't blow up the series.
+// the closed muxes are dropped at the next scrape, their counters are kept in the aggregate.
+type MetricsRegistry struct {
+	muxes   map[*Mux]string
+	names   map[string]*Mux // the muxes registered with a name
+	retired Stats           // the counters of the muxes dropped
+	sync.Mutex
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{
+		muxes: make(map[*Mux]string),
+		names: make(map[string]*Mux),
+	}
+}
+
+// Register add the mux to the registry, name is the value of the mux label, empty for the aggregate only.
+// the name can't be used by another mux not closed, the series of the same labels are rejected by Prometheus,
+// a closed one is dropped, so a reconnected client can be registered with the same name.
+func (Self *MetricsRegistry) Register(m *Mux, name string) error {
+	Self.Lock()
+	defer Self.Unlock()
+	if name != "" {
+		if other, ok := Self.names[name]; ok && other != m {
+			if !other.IsClose {
+				return errors.New("metrics: the mux name is registered")
+			}
+			Self.drop(other, other.Stats())
+		}
+	}
+	if old, ok := Self.muxes[m]; ok && old != name {
+		delete(Self.names, old)
+	}
+	Self.muxes[m] = name
+	if name != "" {
+		Self.names[name] = m
+	}
+	return nil
+}
+
+// Unregister remove the mux from the registry, its counters are kept in the aggregate
+func (Self *MetricsRegistry) Unregister(m *Mux) {
+	Self.Lock()
+	if _, ok := Self.muxes[m]; ok {
+		Self.drop(m, m.Stats())
+	}
+	Self.Unlock()
+}
+
+// drop remove the registered mux and keep its counters, the caller holds the lock
+func (Self *MetricsRegistry) drop(m *Mux, stats Stats) {
+	if name := Self.muxes[m]; name != "" {
+		delete(Self.names, name)
+	}
+	delete(Self.muxes, m)
+	addCounters(&Self.retired, stats)
+}
+
+// addCounters add the counters of src to dst, the gauges are not added
+func addCounters(dst *Stats, src Stats) {
+	if dst.SentFrames == nil {
+		dst.SentFrames = make(map[string]FrameStats, len(frameNames))
+		dst.ReceivedFrames = make(map[string]FrameStats, len(frameNames))
+	}
+	for name, v := range src.SentFrames {
+		old := dst.SentFrames[name]
+		dst.SentFrames[name] = FrameStats{Frames: old.Frames + v.Frames, Bytes: old.Bytes + v.Bytes}
+	}
+	for name, v := range src.ReceivedFrames {
+		old := dst.ReceivedFrames[name]
+		dst.ReceivedFrames[name] = FrameStats{Frames: old.Frames + v.Frames, Bytes: old.Bytes + v.Bytes}
+	}
+	dst.TotalStreams += src.TotalStreams
+	dst.RefusedStreams += src.RefusedStreams
+	dst.PingFailures += src.PingFailures
+}
+
+type namedStats struct {
+	name string
+	Stats
+}
+
+// collect returns the aggregate of the registered muxes and the retired counters,
+// and the stats of the named muxes sorted by name
+func (Self *MetricsRegistry) collect() (total Stats, named []namedStats, count int) {
+	Self.Lock()
+	defer Self.Unlock()
+	addCounters(&total, Self.retired)
+	for m, name := range Self.muxes {
+		stats := m.Stats()
+		if m.IsClose {
+			Self.drop(m, stats)
+			addCounters(&total, stats)
+			continue
+		}
+		count++
+		addCounters(&total, stats)
+		total.ActiveStreams += stats.ActiveStreams
+		total.Memory += stats.Memory
+		total.Queue.Ping += stats.Queue.Ping
+		total.Queue.Control += stats.Queue.Control
+		total.Queue.Session += stats.Queue.Session
+		total.Queue.High += stats.Queue.High
+		total.Queue.Normal += stats.Queue.Normal
+		total.Queue.Low += stats.Queue.Low
+		if name != "" {
+			named = append(named, namedStats{name: name, Stats: stats})
+		}
+	}
+	sort.Slice(named, func(i, j int) bool {
+		return named[i].name < named[j].name
+	})
+	return
+}
+
+// ServeHTTP write the metrics in the Prometheus text exposition format
+func (Self *MetricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_ = Self.WriteText(w)
+}
+
+// WriteText write the metrics in the Prometheus text exposition format to w
+func (Self *MetricsRegistry) WriteText(w io.Writer) error {
+	total, named, count := Self.collect()
+	mw := &metricsWriter{w: bufio.NewWriter(w)}
+
+	mw.family("npsmux_muxes", "gauge", "Muxes registered and not closed.")
+	mw.sample("npsmux_muxes", nil, float64(count))
+	frameFamily := func(name, help string, frames map[string]FrameStats, bytes bool) {
+		mw.family(name, "counter", help)
+		for _, t := range frameNames {
+			v := float64(frames[t].Frames)
+			if bytes {
+				v = float64(frames[t].Bytes)
+			}
+			mw.sample(name, []string{"type", t}, v)
+		}
+	}
+	frameFamily("npsmux_frames_sent_total", "Frames written by all the muxes.", total.SentFrames, false)
+	frameFamily("npsmux_frames_received_total", "Frames read by all the muxes.", total.ReceivedFrames, false)
+	frameFamily("npsmux_frame_bytes_sent_total", "Bytes of the frames written by all the muxes, including the headers.",
+		total.SentFrames, true)
+	frameFamily("npsmux_frame_bytes_received_total", "Bytes of the frames read by all the muxes, including the headers.",
+		total.ReceivedFrames, true)
+	mw.family("npsmux_streams_active", "gauge", "Streams open.")
+	mw.sample("npsmux_streams_active", nil, float64(total.ActiveStreams))
+	mw.family("npsmux_streams_total", "counter", "Streams opened and accepted.")
+	mw.sample("npsmux_streams_total", nil, float64(total.TotalStreams))
+	mw.family("npsmux_streams_refused_total", "counter", "Streams failed to open.")
+	mw.sample("npsmux_streams_refused_total", nil, float64(total.RefusedStreams))
+	mw.family("npsmux_ping_failures_total", "counter", "Ping probes not answered in time.")
+	mw.sample("npsmux_ping_failures_total", nil, float64(total.PingFailures))
+	mw.family("npsmux_write_queue_frames", "gauge", "Frames waiting in the write queues by priority class.")
+	for _, class := range []struct {
+		name string
+		n    int64
+	}{
+		{"ping", total.Queue.Ping}, {"control", total.Queue.Control}, {"session", total.Queue.Session},
+		{"high", total.Queue.High}, {"normal", total.Queue.Normal}, {"low", total.Queue.Low},
+	} {
+		mw.sample("npsmux_write_queue_frames", []string{"class", class.name}, float64(class.n))
+	}
+	mw.family("npsmux_buffered_bytes", "gauge", "Bytes buffered in the receive windows and write queues of the muxes registered.")
+	mw.sample("npsmux_buffered_bytes", nil, float64(total.Memory))
+
+	// the process wide buffers, not only the muxes registered
+	memory := Memory()
+	mw.family("npsmux_process_buffered_bytes", "gauge", "Bytes buffered by all the muxes of the process.")
+	mw.sample("npsmux_process_buffered_bytes", nil, float64(memory.Buffered))
+	mw.family("npsmux_process_buffered_limit_bytes", "gauge", "The memory limit of the muxes, zero means no limit.")
+	mw.sample("npsmux_process_buffered_limit_bytes", nil, float64(memory.Limit))
+	mw.family("npsmux_pool_gets_total", "counter", "Window buffers taken from the pool.")
+	mw.sample("npsmux_pool_gets_total", nil, float64(memory.PoolGets))
+	mw.family("npsmux_pool_puts_total", "counter", "Window buffers returned to the pool.")
+	mw.sample("npsmux_pool_puts_total", nil, float64(memory.PoolPuts))
+	mw.family("npsmux_pool_buffers_in_use", "gauge", "Window buffers taken from the pool and not returned.")
+	mw.sample("npsmux_pool_buffers_in_use", nil, float64(int64(memory.PoolGets-memory.PoolPuts)))
+
+	perMux := func(name, typ, help string, value func(stats *namedStats) float64) {
+		if len(named) == 0 {
+			return
+		}
+		mw.family(name, typ, help)
+		for i := range named {
+			mw.sample(name, []string{"mux", named[i].name}, value(&named[i]))
+		}
+	}
+	perMux("npsmux_mux_bytes_sent_total", "counter", "Bytes of the frames written by the mux.", func(s *namedStats) float64 {
+		return float64(s.Sent.Bytes)
+	})
+	perMux("npsmux_mux_bytes_received_total", "counter", "Bytes of the frames read by the mux.", func(s *namedStats) float64 {
+		return float64(s.Received.Bytes)
+	})
+	perMux("npsmux_mux_frames_sent_total", "counter", "Frames written by the mux.", func(s *namedStats) float64 {
+		return float64(s.Sent.Frames)
+	})
+	perMux("npsmux_mux_frames_received_total", "counter", "Frames read by the mux.", func(s *namedStats) float64 {
+		return float64(s.Received.Frames)
+	})
+	perMux("npsmux_mux_streams_active", "gauge", "Streams open in the mux.", func(s *namedStats) float64 {
+		return float64(s.ActiveStreams)
+	})
+	perMux("npsmux_mux_streams_total", "counter", "Streams opened and accepted by the mux.", func(s *namedStats) float64 {
+		return float64(s.TotalStreams)
+	})
+	perMux("npsmux_mux_write_queue_frames", "gauge", "Frames waiting in the write queue of the mux.", func(s *namedStats) float64 {
+		q := s.Queue
+		return float64(q.Ping + q.Control + q.Session + q.High + q.Normal + q.Low)
+	})
+	perMux("npsmux_mux_rtt_seconds", "gauge", "Smoothed round trip time of the mux.", func(s *namedStats) float64 {
+		return s.RTT.Smoothed.Seconds()
+	})
+	perMux("npsmux_mux_rtt_min_seconds", "gauge", "Min round trip time of the mux in the last 5 minutes.", func(s *namedStats) float64 {
+		return s.RTT.Min.Seconds()
+	})
+	perMux("npsmux_mux_bandwidth_bytes_per_second", "gauge", "Estimated bandwidth from the remote side.", func(s *namedStats) float64 {
+		return s.Bandwidth
+	})
+	perMux("npsmux_mux_send_window_bytes", "gauge", "Bytes the streams can send now, the session window of the remote side.",
+		func(s *namedStats) float64 {
+			return float64(s.SendWindow)
+		})
+	perMux("npsmux_mux_receive_budget_bytes", "gauge", "Bytes the remote side can send to all the streams.", func(s *namedStats) float64 {
+		return float64(s.ReceiveBudget)
+	})
+	perMux("npsmux_mux_buffered_bytes", "gauge", "Bytes buffered in the receive windows and write queue of the mux.",
+		func(s *namedStats) float64 {
+			return float64(s.Memory)
+		})
+	perMux("npsmux_mux_ping_failures_total", "counter", "Ping probes of the mux not answered in time.", func(s *namedStats) float64 {
+		return float64(s.PingFailures)
+	})
+	perMux("npsmux_mux_uptime_seconds", "gauge", "Seconds since the mux created.", func(s *namedStats) float64 {
+		return s.Uptime.Seconds()
+	})
+	return mw.flush()
+}
+
+// metricsWriter write the Prometheus text exposition format, the samples of a family must be written together
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (Self *metricsWriter) family(name, typ, help string) {
+	_, _ = Self.w.WriteString("# HELP " + name + " " + help + "\n")
+	_, _ = Self.w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// sample write a sample, labels are the name and value pairs
+func (Self *metricsWriter) sample(name string, labels []string, value float64) {
+	_, _ = Self.w.WriteString(name)
+	if len(labels) > 0 {
+		_ = Self.w.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				_ = Self.w.WriteByte(',')
+			}
+			_, _ = Self.w.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		_ = Self.w.WriteByte('}')
+	}
+	_ = Self.w.WriteByte(' ')
+	_, _ = Self.w.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	_ = Self.w.WriteByte('\n')
+}
+
+func (Self *metricsWriter) flush() error {
+	return Self.w.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
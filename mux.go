@@ -6,7 +6,7 @@ import (
 	"log"
 	"math"
 	"net"
-	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -21,6 +21,16 @@ const (
 	muxNewConn
 	muxConnClose
 	muxPingReturn
+	muxFrameRegister // announce the extension flag which has a handler, id is the flag
+	muxSessionMsg
+	muxSessionMsgPart
+	muxDatagram
+	muxSessionWindow         // window is the absolute offset of stream data can be sent by all streams
+	muxWindowProbe           // ask the remote side to advertise the windows again, id zero for the session window
+	muxCapabilities          // announce the features supported, id is the bitmap
+	muxWindowUpdate          // window is the absolute offset of the stream data read, size is the max window size
+	muxSessionMsgRead        // the application read the session messages, id is the number of their frames
+	muxFlags                 // the number of the builtin flags
 	muxPing            int32 = -1
 	maximumSegmentSize       = poolSizeWindow
 	maximumWindowSize        = 1 << 27 // 1<<31-1 TCP slide window size is very large,
@@ -28,31 +38,49 @@ const (
 )
 
 type Mux struct {
-	latency uint64 // we store latency in bits, but it's float64
+	// the 64 bits fields accessed by atomics must be first, only the start of an allocated struct
+	// is 8 bytes aligned on the 32 bits platforms, e.g. the ARM and MIPS routers
+	memory          int64 // bytes buffered in receive windows and write queue
+	datagramDropped uint64
+	msgDropped      uint64 // session messages dropped, too large or more than the remote side could send
+	remoteCaps      uint32 // the features the remote side announced
 	net.Listener
-	conn               net.Conn
-	connMap            *connMap
-	newConnCh          chan *conn
-	id                 int32
-	closeChan          chan struct{}
-	IsClose            bool
-	counter            *latencyCounter
-	bw                 *bandwidth
-	pingCh             chan []byte
-	pingCheckTime      uint32 // we check the ping per 5s
-	pingCheckThreshold uint32
-	connType           string
-	writeQueue         priorityQueue
-	newConnQueue       connQueue
+	conn             net.Conn
+	connMap          *connMap
+	newConnCh        chan *conn
+	id               int32
+	closeChan        chan struct{}
+	closeOnce        sync.Once
+	capsKnown        chan struct{} // closed at the first frame received, the remote features are known
+	capsOnce         sync.Once
+	IsClose          bool
+	rtt              *rttEstimator
+	counters         *muxCounters
+	bw               *bandwidth
+	pinger           *pinger
+	deadPeerHandler  atomic.Value
+	tracer           atomic.Value
+	capture          atomic.Value
+	connType         string
+	writeQueue       *priorityQueue
+	newConnQueue     connQueue
+	frames           *frameRegistry
+	msgLock          sync.Mutex
+	msgSlots         chan struct{} // the message frames sent and not read by the remote application yet
+	msgQueue         chan sessionMsg
+	msgCh            chan []byte
+	msgBuf           []byte // session message received, only used in read session
+	msgFrames        int32
+	msgDrop          bool
+	datagramCh       chan datagram
+	windowController atomic.Value
+	receiveBudget    *sessionReceiveWindow
+	sendBudget       *sessionSendWindow
 }
 
 func NewMux(c net.Conn, connType string, pingCheckThreshold int) *Mux {
 	//c.(*net.TCPConn).SetReadBuffer(0)
 	//c.(*net.TCPConn).SetWriteBuffer(0)
-	fd, err := getConnFd(c)
-	if err != nil {
-		log.Println(err)
-	}
 	var checkThreshold uint32
 	if pingCheckThreshold <= 0 {
 		if connType == "kcp" {
@@ -64,20 +92,30 @@ func NewMux(c net.Conn, connType string, pingCheckThreshold int) *Mux {
 		checkThreshold = uint32(pingCheckThreshold)
 	}
 	m := &Mux{
-		conn:               c,
-		connMap:            NewConnMap(),
-		id:                 0,
-		closeChan:          make(chan struct{}, 1),
-		newConnCh:          make(chan *conn),
-		bw:                 NewBandwidth(fd),
-		IsClose:            false,
-		connType:           connType,
-		pingCh:             make(chan []byte),
-		pingCheckThreshold: checkThreshold,
-		counter:            newLatencyCounter(),
+		conn:       c,
+		writeQueue: new(priorityQueue),
+		connMap:    NewConnMap(),
+		id:         0,
+		closeChan:  make(chan struct{}),
+		capsKnown:  make(chan struct{}),
+		newConnCh:  make(chan *conn),
+		bw:         newBandwidth(),
+		IsClose:    false,
+		connType:   connType,
+		pinger:     newPinger(time.Duration(checkThreshold) * pingInterval),
+		rtt:        newRttEstimator(),
+		counters:   newMuxCounters(),
+		frames:     newFrameRegistry(),
+		msgSlots:   make(chan struct{}, messageQueueSize),
+		msgQueue:   make(chan sessionMsg, messageQueueSize),
+		msgCh:      make(chan []byte),
+		datagramCh: make(chan datagram, datagramQueueSize),
 	}
+	m.receiveBudget = newSessionReceiveWindow(m)
+	m.sendBudget = newSessionSendWindow(m)
 	m.writeQueue.New()
 	m.newConnQueue.New()
+	m.announceCapabilities()
 	//read session by flag
 	m.readSession()
 	//ping
@@ -94,14 +132,19 @@ func (s *Mux) NewConn() (*conn, error) {
 	//it must be Set before send
 	s.connMap.Set(conn.connId, conn)
 	s.sendInfo(muxNewConn, conn.connId, nil)
+	s.traceStream(conn.connId, StreamOpening)
 	//Set a timer timeout 120 second
 	timer := time.NewTimer(time.Minute * 2)
 	defer timer.Stop()
 	select {
 	case <-conn.connStatusOkCh:
+		atomic.AddUint64(&s.counters.totalStreams, 1)
+		s.traceStream(conn.connId, StreamOpened)
 		return conn, nil
 	case <-timer.C:
 	}
+	atomic.AddUint64(&s.counters.refusedStreams, 1)
+	s.traceStream(conn.connId, StreamRefused)
 	return nil, errors.New("create connection fail，the server refused the connection")
 }
 
@@ -121,6 +164,10 @@ func (s *Mux) Addr() net.Addr {
 }
 
 func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
+	s.sendPriorityInfo(flag, id, PriorityNormal, data)
+}
+
+func (s *Mux) sendPriorityInfo(flag uint8, id int32, priority uint8, data interface{}) {
 	if s.IsClose {
 		return
 	}
@@ -133,10 +180,25 @@ func (s *Mux) sendInfo(flag uint8, id int32, data interface{}) {
 		_ = s.Close()
 		return
 	}
+	pack.priority = priority
+	s.addMemory(int64(pack.length))
 	s.writeQueue.Push(pack)
 	return
 }
 
+// sendContent queue the data frame with the content buffer from windowBuff, no copy
+func (s *Mux) sendContent(flag uint8, id int32, priority uint8, content []byte) {
+	if s.IsClose {
+		windowBuff.Put(content)
+		return
+	}
+	pack := muxPack.Get()
+	pack.SetContent(flag, id, content)
+	pack.priority = priority
+	s.addMemory(int64(pack.length))
+	s.writeQueue.Push(pack)
+}
+
 func (s *Mux) writeSession() {
 	go func() {
 		for {
@@ -144,16 +206,21 @@ func (s *Mux) writeSession() {
 				break
 			}
 			pack := s.writeQueue.Pop()
+			if pack != nil {
+				s.addMemory(-int64(pack.length))
+			}
 			if s.IsClose {
 				break
 			}
-			//if pack.flag == muxNewMsg || pack.flag == muxNewMsgPart {
-			//	if pack.length >= 100 {
-			//		log.Println("write session id", pack.id, "\n", string(pack.content[:100]))
-			//	} else {
-			//		log.Println("write session id", pack.id, "\n", string(pack.content[:pack.length]))
-			//	}
-			//}
+			tracer := s.getTracer()
+			var info FrameInfo
+			if tracer != nil {
+				info = pack.frameInfo()
+			}
+			if capture := s.getCapture(); capture != nil {
+				capture.record(true, pack)
+			}
+			flag, size := pack.flag, pack.frameSize()
 			err := pack.Pack(s.conn)
 			muxPack.Put(pack)
 			if err != nil {
@@ -161,16 +228,19 @@ func (s *Mux) writeSession() {
 				_ = s.Close()
 				break
 			}
+			s.counters.frameSent(flag, size)
+			if tracer != nil {
+				tracer.FrameSent(info)
+			}
 		}
 	}()
 }
 
 func (s *Mux) ping() {
 	go func() {
-		now, _ := time.Now().UTC().MarshalText()
-		s.sendInfo(muxPingFlag, muxPing, now)
+		s.sendPing()
 		// send the ping flag and Get the latency first
-		ticker := time.NewTicker(time.Second * 5)
+		ticker := time.NewTicker(pingInterval)
 		defer ticker.Stop()
 		for {
 			if s.IsClose {
@@ -178,45 +248,16 @@ func (s *Mux) ping() {
 			}
 			select {
 			case <-ticker.C:
-			}
-			if atomic.LoadUint32(&s.pingCheckTime) > s.pingCheckThreshold {
-				log.Println("mux: ping time out, checktime", s.pingCheckTime, "threshold", s.pingCheckThreshold)
-				_ = s.Close()
-				// more than limit times not receive the ping return package,
-				// mux conn is damaged, maybe a packet drop, close it
-				break
-			}
-			now, _ = time.Now().UTC().MarshalText()
-			s.sendInfo(muxPingFlag, muxPing, now)
-			atomic.AddUint32(&s.pingCheckTime, 1)
-		}
-		return
-	}()
-
-	go func() {
-		var now time.Time
-		var data []byte
-		for {
-			if s.IsClose {
-				break
-			}
-			select {
-			case data = <-s.pingCh:
-				atomic.StoreUint32(&s.pingCheckTime, 0)
 			case <-s.closeChan:
-				break
-			}
-			_ = now.UnmarshalText(data)
-			latency := time.Now().UTC().Sub(now).Seconds()
-			if latency > 0 {
-				atomic.StoreUint64(&s.latency, math.Float64bits(s.counter.Latency(latency)))
-				// convert float64 to bits, store it atomic
-				//log.Println("ping", math.Float64frombits(atomic.LoadUint64(&s.latency)))
+				return
 			}
-			if cap(data) > 0 && !s.IsClose {
-				windowBuff.Put(data)
+			if !s.pinger.isIdle() {
+				continue // the remote side is sending, no need to probe
 			}
+			s.sendPing()
+			// the mux is closed if nothing received within the liveness timeout
 		}
+		return
 	}()
 }
 
@@ -233,6 +274,8 @@ func (s *Mux) readSession() {
 			}
 			s.connMap.Set(connection.connId, connection) //it has been Set before send ok
 			s.newConnCh <- connection
+			atomic.AddUint64(&s.counters.totalStreams, 1)
+			s.traceStream(connection.connId, StreamOpened)
 			s.sendInfo(muxNewConnOk, connection.connId, nil)
 		}
 	}()
@@ -240,28 +283,35 @@ func (s *Mux) readSession() {
 		var pack *muxPackager
 		var l uint16
 		var err error
+		defer close(s.msgQueue)
+		defer close(s.datagramCh)
 		for {
 			if s.IsClose {
 				return
 			}
+			s.waitMemory()
 			pack = muxPack.Get()
-			s.bw.StartRead()
 			if l, err = pack.UnPack(s.conn); err != nil {
 				log.Println("mux: read session unpack from connection err", err)
 				_ = s.Close()
 				break
 			}
 			s.bw.SetCopySize(l)
-			//if pack.flag == muxNewMsg || pack.flag == muxNewMsgPart {
-			//	if pack.length >= 100 {
-			//		log.Printf("read session id %d pointer %p\n%v", pack.id, pack.content, string(pack.content[:100]))
-			//	} else {
-			//		log.Printf("read session id %d pointer %p\n%v", pack.id, pack.content, string(pack.content[:pack.length]))
-			//	}
-			//}
+			s.counters.frameReceived(pack.flag, uint32(l))
+			s.pinger.received()
+			if tracer := s.getTracer(); tracer != nil {
+				tracer.FrameReceived(pack.frameInfo())
+			}
+			if capture := s.getCapture(); capture != nil {
+				capture.record(false, pack)
+			}
+			if pack.flag != muxCapabilities {
+				s.capabilitiesKnown() // the old peers never announce
+			}
 			switch pack.flag {
 			case muxNewConn: //New connection
 				connection := NewConn(pack.id, s)
+				s.traceStream(pack.id, StreamOpening)
 				s.newConnQueue.Push(connection)
 				continue
 			case muxPingFlag: //ping
@@ -269,7 +319,39 @@ func (s *Mux) readSession() {
 				windowBuff.Put(pack.content)
 				continue
 			case muxPingReturn:
-				s.pingCh <- pack.content
+				s.pingReturn(pack.content)
+				continue
+			case muxSessionMsg, muxSessionMsgPart:
+				s.newSessionMsg(pack)
+				continue
+			case muxSessionMsgRead:
+				s.sessionMsgRead(pack.id)
+				muxPack.Put(pack)
+				continue
+			case muxDatagram:
+				s.newDatagram(pack)
+				continue
+			case muxSessionWindow:
+				s.sendBudget.SetLimit(pack.window)
+				muxPack.Put(pack)
+				continue
+			case muxWindowProbe:
+				s.windowProbe(pack.id)
+				muxPack.Put(pack)
+				continue
+			case muxCapabilities:
+				s.setRemoteCapabilities(uint32(pack.id))
+				muxPack.Put(pack)
+				continue
+			case muxFrameRegister:
+				if pack.id >= int32(ExtensionFlagMin) && pack.id <= int32(ExtensionFlagMax) {
+					s.frames.SetRemote(uint8(pack.id))
+				}
+				muxPack.Put(pack)
+				continue
+			}
+			if pack.flag >= ExtensionFlagMin {
+				s.handleFrame(pack)
 				continue
 			}
 			if connection, ok := s.connMap.Get(pack.id); ok && !connection.isClose {
@@ -278,6 +360,9 @@ func (s *Mux) readSession() {
 					err = s.newMsg(connection, pack)
 					if err != nil {
 						log.Println("mux: read session connection New msg err", err)
+						s.receiveBudget.Consume(uint32(pack.length))
+						windowBuff.Put(pack.content)
+						// data not push into the receive window, drop it
 						_ = connection.Close()
 					}
 					continue
@@ -287,23 +372,39 @@ func (s *Mux) readSession() {
 				case muxNewConnFail:
 					connection.connStatusFailCh <- struct{}{}
 					continue
-				case muxMsgSendOk:
+				case muxWindowUpdate:
+					if connection.isClose {
+						continue
+					}
+					connection.sendWindow.SetSize(pack.window, pack.size)
+					continue
+				case muxMsgSendOk: // the window update of the old peers
 					if connection.isClose {
 						continue
 					}
-					connection.sendWindow.SetSize(pack.window)
+					maxSize, read := unpackLegacyWindow(pack.window)
+					connection.sendWindow.SetLegacySize(maxSize, read)
 					continue
 				case muxConnClose: //close the connection
 					connection.closingFlag = true
+					s.traceStream(pack.id, StreamClosing)
 					connection.receiveWindow.Stop() // close signal to receive window
 					continue
 				}
 			} else if pack.flag == muxConnClose {
 				continue
 			}
+			if isData(pack.flag) {
+				s.receiveBudget.Consume(uint32(pack.length))
+				// the stream is closed, the data is dropped
+			}
+			if pack.content != nil {
+				windowBuff.Put(pack.content)
+			}
 			muxPack.Put(pack)
 		}
 	}()
+	go s.deliverMessages()
 }
 
 func (s *Mux) newMsg(connection *conn, pack *muxPackager) (err error) {
@@ -311,6 +412,7 @@ func (s *Mux) newMsg(connection *conn, pack *muxPackager) (err error) {
 		err = io.ErrClosedPipe
 		return
 	}
+	s.receiveBudget.Start()
 	//insert into queue
 	if pack.flag == muxNewMsgPart {
 		err = connection.receiveWindow.Write(pack.content, pack.length, true, pack.id)
@@ -322,21 +424,30 @@ func (s *Mux) newMsg(connection *conn, pack *muxPackager) (err error) {
 }
 
 func (s *Mux) Close() (err error) {
-	if s.IsClose {
-		return errors.New("the mux has closed")
-	}
+	err = errors.New("the mux has closed")
+	// the read session, the ping and the application may close the mux at the same time
+	s.closeOnce.Do(func() {
+		err = nil
+		s.close()
+	})
+	return
+}
+
+func (s *Mux) close() {
 	s.IsClose = true
 	log.Println("close mux")
+	close(s.closeChan)
+	// wake up the streams waiting for the window first, they may be flushing in Close
 	s.connMap.Close()
+	s.pinger.stop()
+	_ = s.StopCapture()
 	//s.connMap = nil
-	s.closeChan <- struct{}{}
 	close(s.newConnCh)
 	// while target host close socket without finish steps, conn.Close method maybe blocked
 	// and tcp status change to CLOSE WAIT or TIME WAIT, so we close it in other goroutine
 	_ = s.conn.SetDeadline(time.Now().Add(time.Second * 5))
 	go s.conn.Close()
 	s.release()
-	return
 }
 
 func (s *Mux) release() {
@@ -345,6 +456,7 @@ func (s *Mux) release() {
 		if pack == nil {
 			break
 		}
+		s.addMemory(-int64(pack.length))
 		if pack.basePackager.content != nil {
 			windowBuff.Put(pack.basePackager.content)
 		}
@@ -374,49 +486,53 @@ func (s *Mux) getId() (id int32) {
 	return
 }
 
+const (
+	bandwidthSampleInterval = time.Millisecond * 200
+	bandwidthFilterLength   = 10
+)
+
+// bandwidth estimate the delivery rate of the mux connection from the frame arrival time,
+// it works for every net.Conn, no matter what the underlying transport is.
+// every sample is the bytes delivered in an interval, like BBR, the estimation is the max of the recent samples,
+// so the samples measured while the remote side has not enough data to send are filtered out.
 type bandwidth struct {
 	readBandwidth uint64 // store in bits, but it's float64
-	readStart     time.Time
-	lastReadStart time.Time
-	bufLength     uint32
-	fd            *os.File
-	calcThreshold uint32
+	sampleStart   time.Time
+	sampleBytes   uint32
+	samples       [bandwidthFilterLength]float64
+	idx           uint8
 }
 
-func NewBandwidth(fd *os.File) *bandwidth {
-	return &bandwidth{fd: fd}
+func newBandwidth() *bandwidth {
+	return new(bandwidth)
 }
 
-func (Self *bandwidth) StartRead() {
-	if Self.readStart.IsZero() {
-		Self.readStart = time.Now()
+func (Self *bandwidth) SetCopySize(n uint16) {
+	now := time.Now()
+	if Self.sampleStart.IsZero() {
+		Self.sampleStart = now
+		// the first frame, we don't know how long it takes to deliver, so it's not counted
+		return
 	}
-	if Self.bufLength >= Self.calcThreshold {
-		Self.lastReadStart, Self.readStart = Self.readStart, time.Now()
-		Self.calcBandWidth()
+	Self.sampleBytes += uint32(n)
+	if t := now.Sub(Self.sampleStart); t >= bandwidthSampleInterval {
+		Self.addSample(float64(Self.sampleBytes) / t.Seconds())
+		Self.sampleStart = now
+		Self.sampleBytes = 0
 	}
 }
 
-func (Self *bandwidth) SetCopySize(n uint16) {
-	Self.bufLength += uint32(n)
-}
-
-func (Self *bandwidth) calcBandWidth() {
-	t := Self.readStart.Sub(Self.lastReadStart)
-	bufferSize, err := sysGetSock(Self.fd)
-	if err != nil {
-		log.Println(err)
-		Self.bufLength = 0
-		return
-	}
-	if Self.bufLength >= uint32(bufferSize) {
-		atomic.StoreUint64(&Self.readBandwidth, math.Float64bits(float64(Self.bufLength)/t.Seconds()))
-		// calculate the whole socket buffer, the time meaning to fill the buffer
-	} else {
-		Self.calcThreshold = uint32(bufferSize)
+func (Self *bandwidth) addSample(bw float64) {
+	Self.samples[Self.idx] = bw
+	Self.idx = (Self.idx + 1) % bandwidthFilterLength
+	// replace the oldest sample
+	var max float64
+	for _, v := range Self.samples {
+		if v > max {
+			max = v
+		}
 	}
-	// socket buffer size is bigger than bufLength, so we don't calculate it
-	Self.bufLength = 0
+	atomic.StoreUint64(&Self.readBandwidth, math.Float64bits(max))
 }
 
 func (Self *bandwidth) Get() (bw float64) {
@@ -428,87 +544,8 @@ func (Self *bandwidth) Get() (bw float64) {
 	return
 }
 
-const counterBits = 4
-const counterMask = 1<<counterBits - 1
-
-func newLatencyCounter() *latencyCounter {
-	return &latencyCounter{
-		buf:     make([]float64, 1<<counterBits, 1<<counterBits),
-		headMin: 0,
-	}
-}
-
-type latencyCounter struct {
-	buf []float64 //buf is a fixed length ring buffer,
-	// if buffer is full, New value will replace the oldest one.
-	headMin uint8 //head indicate the head in ring buffer,
-	// in meaning, slot in list will be replaced;
-	// min indicate this slot value is minimal in list.
-
-	// we delineate the effective range with three times the minimum latency
-	// average of effective latency for all current data as a mux latency
-}
-
-func (Self *latencyCounter) unpack(idxs uint8) (head, min uint8) {
-	head = (idxs >> counterBits) & counterMask
-	// we Set head is 4 bits
-	min = idxs & counterMask
-	return
-}
-
-func (Self *latencyCounter) pack(head, min uint8) uint8 {
-	return head<<counterBits |
-		min&counterMask
-}
-
-func (Self *latencyCounter) add(value float64) {
-	head, min := Self.unpack(Self.headMin)
-	Self.buf[head] = value
-	if head == min {
-		min = Self.minimal()
-		//if head equals min, means the min slot already be replaced,
-		// so we need to find another minimal value in the list,
-		// and change the min indicator
-	}
-	if Self.buf[min] > value {
-		min = head
-	}
-	head++
-	Self.headMin = Self.pack(head, min)
-}
-
-func (Self *latencyCounter) minimal() (min uint8) {
-	var val float64
-	var i uint8
-	for i = 0; i < counterMask; i++ {
-		if Self.buf[i] > 0 {
-			if val > Self.buf[i] {
-				val = Self.buf[i]
-				min = i
-			}
-		}
-	}
-	return
-}
-
-func (Self *latencyCounter) Latency(value float64) (latency float64) {
-	Self.add(value)
-	latency = Self.countSuccess()
-	return
-}
-
-const lossRatio = 3
-
-func (Self *latencyCounter) countSuccess() (successRate float64) {
-	var i, success uint8
-	_, min := Self.unpack(Self.headMin)
-	for i = 0; i < counterMask; i++ {
-		if Self.buf[i] <= lossRatio*Self.buf[min] && Self.buf[i] > 0 {
-			success++
-			successRate += Self.buf[i]
-		}
-	}
-	// counting all the data in the ring buf, except zero
-	successRate = successRate / float64(success)
-	return
+// Bandwidth returns the estimated bytes per second the mux connection can deliver from the remote side,
+// zero if not measured yet
+func (s *Mux) Bandwidth() float64 {
+	return s.bw.Get()
 }
@@ -3,16 +3,22 @@ package nps_mux
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/http/httputil"
 	_ "net/http/pprof"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -141,16 +147,16 @@ func TestServer(t *testing.T) {
 			go func() {
 				_ = writeResult([]float64{
 					mux.bw.Get() / 1024 / 1024,
-					math.Float64frombits(atomic.LoadUint64(&mux.latency)),
+					mux.RTT().Smoothed.Seconds(),
 				}, serverResultFileName)
 				ticker := time.NewTicker(time.Second * 1)
 				for {
 					select {
 					case <-ticker.C:
-						fmt.Println(mux.bw.Get()/1024/1024, math.Float64frombits(atomic.LoadUint64(&mux.latency)))
+						fmt.Println(mux.bw.Get()/1024/1024, mux.RTT().Smoothed.Seconds())
 						_ = appendResult([]float64{
 							mux.bw.Get() / 1024 / 1024,
-							math.Float64frombits(atomic.LoadUint64(&mux.latency)),
+							mux.RTT().Smoothed.Seconds(),
 						}, serverResultFileName)
 					}
 				}
@@ -193,7 +199,7 @@ func TestClient(t *testing.T) {
 			go func() {
 				_ = writeResult([]float64{
 					mux.bw.Get() / 1024 / 1024,
-					math.Float64frombits(atomic.LoadUint64(&mux.latency)),
+					mux.RTT().Smoothed.Seconds(),
 				}, clientResultFileName)
 				ticker := time.NewTicker(time.Second * 1)
 				for {
@@ -201,7 +207,7 @@ func TestClient(t *testing.T) {
 					case <-ticker.C:
 						_ = appendResult([]float64{
 							mux.bw.Get() / 1024 / 1024,
-							math.Float64frombits(atomic.LoadUint64(&mux.latency)),
+							mux.RTT().Smoothed.Seconds(),
 						}, clientResultFileName)
 					}
 				}
@@ -372,7 +378,7 @@ func TestNewMux2(t *testing.T) {
 			n, err := tmpCpnn.Read(buf)
 			count += float64(n)
 			log.Println(m1.bw.Get())
-			log.Println(uint32(math.Float64frombits(atomic.LoadUint64(&m1.latency))))
+			log.Println(m1.RTT().Smoothed)
 			if err != nil {
 				log.Println(err)
 				break
@@ -701,3 +707,1943 @@ func TestChain(t *testing.T) {
 //	}()
 //	time.Sleep(time.Second * 100000)
 //}
+
+func newMuxPair(t testing.TB, wrap ...func(net.Conn) net.Conn) (m1, m2 *Mux) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			log.Println(err)
+		}
+		accepted <- c
+	}()
+	c1, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	if c2 == nil {
+		t.Fatal("accept mux connection fail")
+	}
+	for _, f := range wrap {
+		c1 = f(c1)
+	}
+	return NewMux(c1, "tcp", 60), NewMux(c2, "tcp", 60)
+}
+
+// waitCapabilities wait for the features of the remote side known, the datagrams sent before are dropped
+func waitCapabilities(t testing.TB, m *Mux) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := m.waitCapabilities(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameHandler(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	if err := m1.SendFrame(ExtensionFlagMin, 1, []byte("hello")); err == nil {
+		t.Fatal("frame sent before remote side register the handler")
+	}
+	received := make(chan string, 1)
+	err := m2.RegisterFrameHandler(ExtensionFlagMin, func(streamID int32, payload []byte) {
+		received <- strconv.Itoa(int(streamID)) + string(payload)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for m1.SendFrame(ExtensionFlagMin, 1, []byte("hello")) != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("remote handler announcement not received")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	select {
+	case s := <-received:
+		if s != "1hello" {
+			t.Fatal("unexpected frame", s)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("frame not received")
+	}
+}
+
+func TestSessionMessage(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	large := bytes.Repeat([]byte{1, 2, 3}, maximumSegmentSize)
+	msgs := [][]byte{[]byte("close tunnel 1"), large, []byte("health")}
+	for _, msg := range msgs {
+		if err := m1.SendMessage(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, msg := range msgs {
+		select {
+		case got := <-m2.Messages():
+			if !bytes.Equal(got, msg) {
+				t.Fatal("message boundary not preserved", len(got), len(msg))
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not received")
+		}
+	}
+}
+
+func TestSessionMessageNotRead(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c)
+	}()
+	// nobody read the messages of m2, the sender blocks, the streams go on
+	for i := 0; i < messageQueueSize; i++ {
+		if err := m1.SendMessage(context.Background(), []byte("health")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	if err := m1.SendMessage(ctx, []byte("health")); err != context.DeadlineExceeded {
+		t.Fatal("message sent while the remote side not read", err)
+	}
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetDeadline(time.Now().Add(time.Second * 5))
+	echoRoundTrip(t, c, 1)
+	for i := 0; i <= messageQueueSize; i++ {
+		if i == messageQueueSize {
+			// the slots are given back after the messages read
+			if err := m1.SendMessage(context.Background(), []byte("health")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		select {
+		case <-m2.Messages():
+		case <-time.After(time.Second * 5):
+			t.Fatal("message not received", i)
+		}
+	}
+	if dropped := atomic.LoadUint64(&m2.msgDropped); dropped != 0 {
+		t.Fatal("messages dropped", dropped)
+	}
+}
+
+func TestSessionMessageOldPeer(t *testing.T) {
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		// m1 is an old peer for m2, it never announce the capabilities
+		return newDropConn(c, func(pack *muxPackager) bool {
+			return pack.flag == muxCapabilities
+		})
+	})
+	defer m1.Close()
+	defer m2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := m2.SendMessage(ctx, []byte("health")); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("message sent to the old peer", err)
+	}
+	if err := m1.SendMessage(ctx, []byte("health")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-m2.Messages():
+		if string(msg) != "health" {
+			t.Fatal("unexpected message", string(msg))
+		}
+	case <-ctx.Done():
+		t.Fatal("message not received")
+	}
+}
+
+func TestCloseConcurrently(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m2.Close()
+	var wg sync.WaitGroup
+	var closed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if m1.Close() == nil {
+				atomic.AddInt32(&closed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if closed != 1 {
+		t.Fatal("mux closed more than once", closed)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	waitCapabilities(t, m1)
+	for i := 0; i < 10; i++ {
+		if err := m1.SendDatagram(int32(i), bytes.Repeat([]byte{byte(i)}, 100+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m1.SendDatagram(1, make([]byte, maximumDatagramSize+1)); err == nil {
+		t.Fatal("datagram larger than the limit sent")
+	}
+	for i := 0; i < 10; i++ {
+		flow, p, err := m2.ReadDatagram()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flow != int32(i) || len(p) != 100+i || p[0] != byte(i) {
+			t.Fatal("unexpected datagram", flow, len(p))
+		}
+	}
+}
+
+func TestDatagramOldPeer(t *testing.T) {
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		// m1 is an old peer for m2, it never announce the capabilities
+		return newDropConn(c, func(pack *muxPackager) bool {
+			return pack.flag == muxCapabilities
+		})
+	})
+	defer m1.Close()
+	defer m2.Close()
+	waitCapabilities(t, m1)
+	waitCapabilities(t, m2)
+	if err := m2.SendDatagram(1, []byte("dns")); !errors.Is(err, ErrNotSupported) {
+		t.Fatal("datagram sent to the old peer", err)
+	}
+	if err := m1.SendDatagram(1, []byte("dns")); err != nil {
+		t.Fatal(err)
+	}
+	if _, p, err := m2.ReadDatagram(); err != nil || string(p) != "dns" {
+		t.Fatal("unexpected datagram", string(p), err)
+	}
+	if sent := m2.Stats().SentFrames["datagram"].Frames; sent != 0 {
+		t.Fatal("datagram frames sent to the old peer", sent)
+	}
+}
+
+// stallConn block the writes until released, the frames wait in the write queue
+type stallConn struct {
+	net.Conn
+	release chan struct{}
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	<-c.release
+	return c.Conn.Write(b)
+}
+
+func TestDatagramCongested(t *testing.T) {
+	stall := make(chan struct{})
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		return &stallConn{Conn: c, release: stall}
+	})
+	defer m1.Close()
+	defer m2.Close()
+	waitCapabilities(t, m1)
+	const n = 100
+	p := make([]byte, maximumDatagramSize)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := m1.SendDatagram(int32(i), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("send datagram blocked while congested", elapsed)
+	}
+	dropped := atomic.LoadUint64(&m1.datagramDropped)
+	if dropped == 0 || dropped >= n {
+		t.Fatal("unexpected datagrams dropped", dropped)
+	}
+	if queued := m1.writeQueue.Len(); queued > datagramQueueLimit+maximumDatagramSize {
+		t.Fatal("write queue over the limit", queued)
+	}
+	close(stall)
+	for i := uint64(0); i < n-dropped; i++ {
+		if _, _, err := m2.ReadDatagram(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if received := atomic.LoadUint64(&m2.datagramDropped); received != 0 {
+		t.Fatal("datagrams dropped by the receiver", received)
+	}
+}
+
+func echoRoundTrip(t *testing.T, c net.Conn, n int) time.Duration {
+	b := []byte{1}
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return time.Now().Sub(start) / time.Duration(n)
+}
+
+// pacedConn write no faster than the rate smoothly, the frames wait in the write queue instead of the socket
+type pacedConn struct {
+	net.Conn
+	rate int
+}
+
+func (c *pacedConn) Write(b []byte) (int, error) {
+	time.Sleep(time.Duration(len(b)) * time.Second / time.Duration(c.rate))
+	return c.Conn.Write(b)
+}
+
+func TestStreamPriority(t *testing.T) {
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		return &pacedConn{Conn: c, rate: 1024 * 1024}
+	})
+	defer m1.Close()
+	defer m2.Close()
+	go func() {
+		for i := 0; ; i++ {
+			c, err := m2.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				// the bulk stream, only the forward direction is loaded
+				go func(c net.Conn) {
+					b := make([]byte, 64*1024)
+					for {
+						if _, err := c.Read(b); err != nil {
+							return
+						}
+					}
+				}(c)
+				continue
+			}
+			go func(c net.Conn) {
+				_ = c.(*conn).SetPriority(PriorityHigh)
+				_, _ = io.Copy(c, c) // echo
+			}(c)
+		}
+	}()
+	// the bulk stream is normal priority, the same as the normal stream measured,
+	// so only the priority of the interactive stream can make the difference
+	bulk, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		b := make([]byte, 64*1024)
+		for {
+			if _, err := bulk.Write(b); err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond * 500)
+	normal, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	interactive, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = interactive.SetPriority(PriorityHigh)
+	normalRtt := echoRoundTrip(t, normal, 20)
+	interactiveRtt := echoRoundTrip(t, interactive, 20)
+	log.Println("round trip under bulk transfer, normal:", normalRtt, "high priority:", interactiveRtt)
+	if interactiveRtt*2 > normalRtt {
+		t.Fatal("high priority stream is not ahead of the bulk transfer", interactiveRtt, normalRtt)
+	}
+}
+
+func TestFairScheduling(t *testing.T) {
+	rate := NewRate(1024 * 1024 * 4)
+	rate.Start()
+	defer rate.Stop()
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		return NewRateConn(rate, c)
+	})
+	defer m1.Close()
+	defer m2.Close()
+	const streams = 4
+	var received [streams + 1]uint64
+	go func() {
+		for {
+			c, err := m2.Accept()
+			if err != nil {
+				return
+			}
+			go func(c *conn) {
+				buf := make([]byte, 32<<10)
+				for {
+					n, err := c.Read(buf)
+					atomic.AddUint64(&received[c.connId], uint64(n))
+					if err != nil {
+						return
+					}
+				}
+			}(c.(*conn))
+		}
+	}()
+	conns := make([]*conn, streams)
+	for i := range conns {
+		c, err := m1.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c
+	}
+	for i, c := range conns {
+		size := 512
+		if i%2 == 0 {
+			size = 64 << 10
+			// a half of the streams write large chunks, the others write small chunks
+		}
+		go func(c *conn, b []byte) {
+			for {
+				if _, err := c.Write(b); err != nil {
+					return
+				}
+			}
+		}(c, make([]byte, size))
+	}
+	time.Sleep(time.Second)
+	var start [streams + 1]uint64
+	for i := range start {
+		start[i] = atomic.LoadUint64(&received[i])
+	}
+	time.Sleep(time.Second * 3)
+	var min, max uint64
+	for i := 1; i <= streams; i++ {
+		n := atomic.LoadUint64(&received[i]) - start[i]
+		log.Println("stream", i, "received", n)
+		if min == 0 || n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	if min == 0 || float64(min)/float64(max) < 0.5 {
+		t.Fatal("streams don't get equal throughput shares", min, max)
+	}
+}
+
+func TestFixedWindow(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	m2.SetWindowController(FixedWindow(maximumSegmentSize * 4))
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Second)
+		_, _ = io.Copy(ioutil.Discard, c)
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = c.Write(make([]byte, maximumSegmentSize*100))
+	}()
+	time.Sleep(time.Millisecond * 500)
+	// the remote side don't read, the window is full,
+	// only the initial window can be buffered, the adaptive window would grow and buffer all
+	c2, ok := m2.connMap.Get(c.connId)
+	if !ok {
+		t.Fatal("remote stream not found")
+	}
+	if n := c2.receiveWindow.bufQueue.Len(); n > maximumSegmentSize*30 {
+		t.Fatal("receive window buffered more than the fixed size", n)
+	}
+}
+
+func TestReceiveBudget(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	m2.SetReceiveBudget(maximumSegmentSize * 64)
+	var remotes []*conn
+	var lock sync.Mutex
+	go func() {
+		for {
+			c, err := m2.Accept()
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			remotes = append(remotes, c.(*conn))
+			lock.Unlock()
+		}
+	}()
+	// stream data must be read once, then the budget is advertised
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.Write([]byte{0})
+	time.Sleep(time.Millisecond * 100)
+	lock.Lock()
+	_, _ = remotes[0].Read(make([]byte, 1))
+	lock.Unlock()
+	for i := 0; i < 16; i++ {
+		c, err := m1.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_, _ = c.Write(make([]byte, maximumSegmentSize*256))
+		}()
+	}
+	time.Sleep(time.Second)
+	var buffered uint32
+	lock.Lock()
+	for _, c := range remotes {
+		buffered += c.receiveWindow.bufQueue.Len()
+	}
+	lock.Unlock()
+	log.Println("buffered by all the streams", buffered)
+	if buffered > initialSessionWindow {
+		t.Fatal("buffered data larger than the budget", buffered)
+	}
+}
+
+func TestSessionWindowOldPeer(t *testing.T) {
+	var fc *frameCountConn
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		// m1 is an old peer for m2, it never announce the capabilities or advertise the session window
+		return newDropConn(c, func(pack *muxPackager) bool {
+			return pack.flag == muxCapabilities || pack.flag == muxSessionWindow
+		})
+	}, func(c net.Conn) net.Conn {
+		fc = newFrameCountConn(c)
+		return fc
+	})
+	defer m1.Close()
+	defer m2.Close()
+	const size = initialSessionWindow * 4
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = c.Write(make([]byte, size))
+		_ = c.Close()
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, _ := io.Copy(ioutil.Discard, c)
+	if n != size {
+		t.Fatal("stream stalled by the session window of the old peer", n)
+	}
+	if frames := atomic.LoadUint64(&fc.read[muxSessionWindow]); frames != 0 {
+		t.Fatal("session window sent to the old peer", frames)
+	}
+	if window := m2.Stats().SendWindow; window != math.MaxUint64 {
+		t.Fatal("session window limited without the announcement", window)
+	}
+	if !m1.sendBudget.isEnabled() {
+		t.Fatal("session window not enabled after the announcement")
+	}
+}
+
+func TestMemoryUsage(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	remote := make(chan net.Conn, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		remote <- c
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, maximumSegmentSize*10)
+	if _, err := c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-remote
+	time.Sleep(time.Millisecond * 100)
+	if n := m2.MemoryUsage(); n != int64(len(data)) {
+		t.Fatal("buffered data not accounted", n)
+	}
+	if Memory().Buffered < int64(len(data)) {
+		t.Fatal("global usage less than the mux one", Memory().Buffered)
+	}
+	SetMemoryLimit(maximumSegmentSize)
+	defer SetMemoryLimit(0)
+	// over the limit, transfer slow down but can't be blocked
+	go func() {
+		_, _ = c.Write(data)
+	}()
+	if _, err := io.ReadFull(c2, make([]byte, len(data)*2)); err != nil {
+		t.Fatal(err)
+	}
+	if n := m2.MemoryUsage(); n != 0 {
+		t.Fatal("buffered data not released", n)
+	}
+}
+
+func TestBandwidthWrappedConn(t *testing.T) {
+	rate := NewRate(1024 * 1024 * 16)
+	rate.Start()
+	defer rate.Stop()
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		return NewRateConn(rate, c)
+	})
+	defer m1.Close()
+	defer m2.Close()
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, c)
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	b := make([]byte, 64<<10)
+	for m2.Bandwidth() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("bandwidth of the wrapped connection not measured")
+		}
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Println("bandwidth", m2.Bandwidth())
+}
+
+func TestRTT(t *testing.T) {
+	e := newRttEstimator()
+	e.Update(time.Millisecond * 100)
+	e.Update(time.Millisecond * 20)
+	s := e.Stats()
+	if s.Smoothed != time.Millisecond*90 || s.Variance != time.Microsecond*57500 || s.Min != time.Millisecond*20 || s.Last != time.Millisecond*20 {
+		t.Fatal("wrong rtt stats", s)
+	}
+	if e.Smoothed() != s.Smoothed {
+		t.Fatal("smoothed rtt not stored", e.Smoothed())
+	}
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	deadline := time.Now().Add(time.Second * 2)
+	for m1.RTT().Last == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("rtt not measured")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	s = m1.RTT()
+	if s.Smoothed <= 0 || s.Min > s.Last {
+		t.Fatal("wrong rtt stats", s)
+	}
+}
+
+func TestPing(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	rtt, err := m1.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || m1.RTT().Last == 0 {
+		t.Fatal("rtt not measured", rtt, m1.RTT())
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err = m1.Ping(ctx); err != context.Canceled {
+		t.Fatal("ping not canceled", err)
+	}
+	m1.SetKeepAlive(time.Hour)
+	if m1.pinger.isIdle() {
+		t.Fatal("keepalive probe while receiving")
+	}
+	m1.SetKeepAlive(0)
+	if !m1.pinger.isIdle() {
+		t.Fatal("keepalive not probe by default")
+	}
+}
+
+// blackholeConn stop delivering the data read after blocked, like the remote side is gone
+type blackholeConn struct {
+	net.Conn
+	blocked int32
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newBlackholeConn(c net.Conn) *blackholeConn {
+	return &blackholeConn{Conn: c, done: make(chan struct{})}
+}
+
+func (c *blackholeConn) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.blocked) == 1 {
+		<-c.done
+		return 0, io.EOF
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *blackholeConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func TestDeadPeer(t *testing.T) {
+	var hole *blackholeConn
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		hole = newBlackholeConn(c)
+		return hole
+	})
+	defer m2.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+	defer cancel()
+	if _, err := m1.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	m1.SetLivenessTimeout(time.Millisecond*100, time.Millisecond*500)
+	dead := make(chan time.Duration, 1)
+	m1.SetDeadPeerHandler(func(idle time.Duration) {
+		dead <- idle
+	})
+	atomic.StoreInt32(&hole.blocked, 1)
+	go m1.Ping(context.Background())
+	select {
+	case idle := <-dead:
+		log.Println("dead peer detected, idle", idle)
+	case <-time.After(time.Second * 2):
+		t.Fatal("dead peer not detected")
+	}
+	time.Sleep(time.Millisecond * 10)
+	if !m1.IsClose {
+		t.Fatal("mux not closed")
+	}
+}
+
+// frameCountConn count the frames written to and read from the connection by flag
+type frameCountConn struct {
+	net.Conn
+	written [256]uint64
+	read    [256]uint64
+	wPipe   *io.PipeWriter
+	rPipe   *io.PipeWriter
+}
+
+func newFrameCountConn(c net.Conn) *frameCountConn {
+	fc := &frameCountConn{Conn: c}
+	var wReader, rReader *io.PipeReader
+	wReader, fc.wPipe = io.Pipe()
+	rReader, fc.rPipe = io.Pipe()
+	go fc.count(wReader, &fc.written)
+	go fc.count(rReader, &fc.read)
+	return fc
+}
+
+func (c *frameCountConn) count(r io.Reader, counts *[256]uint64) {
+	for {
+		pack := muxPack.Get()
+		if _, err := pack.UnPack(r); err != nil {
+			return
+		}
+		atomic.AddUint64(&counts[pack.flag], 1)
+		if pack.content != nil {
+			windowBuff.Put(pack.content)
+		}
+		muxPack.Put(pack)
+	}
+}
+
+func (c *frameCountConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	_, _ = c.wPipe.Write(b[:n])
+	return n, err
+}
+
+func (c *frameCountConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	_, _ = c.rPipe.Write(b[:n])
+	return n, err
+}
+
+func (c *frameCountConn) Close() error {
+	_ = c.wPipe.Close()
+	_ = c.rPipe.Close()
+	return c.Conn.Close()
+}
+
+func TestWindowUpdateRatio(t *testing.T) {
+	var fc *frameCountConn
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		fc = newFrameCountConn(c)
+		return fc
+	})
+	defer m1.Close()
+	defer m2.Close()
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, 64<<10)
+		for i := 0; i < 1024; i++ {
+			if _, err := c.Write(b); err != nil {
+				return
+			}
+		}
+		_ = c.Close()
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 64<<20 {
+		t.Fatal("wrong size received", n)
+	}
+	time.Sleep(time.Millisecond * 100)
+	data := atomic.LoadUint64(&fc.read[muxNewMsg]) + atomic.LoadUint64(&fc.read[muxNewMsgPart])
+	updates := atomic.LoadUint64(&fc.written[muxWindowUpdate])
+	ratio := float64(updates) / float64(data)
+	log.Println("data frames", data, "window updates", updates, "ratio", ratio)
+	if ratio > 0.2 {
+		t.Fatal("too many window updates", ratio)
+	}
+}
+
+func BenchmarkBidirectional(b *testing.B) {
+	m1, m2 := newMuxPair(b)
+	defer m1.Close()
+	defer m2.Close()
+	const size = 64 << 10
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c
+	}()
+	c1, err := m1.NewConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+	c2 := <-accepted
+	defer c1.Close()
+	defer c2.Close()
+	// both sides send bulk data on the same stream, the window updates go against the data
+	transfer := func(w, r net.Conn, done chan<- error) {
+		go func() {
+			_, _ = io.CopyN(ioutil.Discard, r, int64(size*b.N))
+		}()
+		buf := make([]byte, size)
+		var err error
+		for i := 0; i < b.N; i++ {
+			if _, err = w.Write(buf); err != nil {
+				break
+			}
+		}
+		done <- err
+	}
+	b.SetBytes(size * 2)
+	b.ResetTimer()
+	done := make(chan error, 2)
+	go transfer(c1, c2, done)
+	go transfer(c2, c1, done)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWindowOffsets(t *testing.T) {
+	pack := muxPack.Get()
+	if err := pack.Set(muxWindowUpdate, 1, windowUpdate{offset: 1 << 40, size: maximumWindowSize}); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := pack.Pack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pack.UnPack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if pack.flag != muxWindowUpdate || pack.window != 1<<40 || pack.size != maximumWindowSize || buf.Len() != 0 {
+		t.Fatal("wrong window update", pack.flag, pack.window, pack.size)
+	}
+	muxPack.Put(pack)
+	w := new(sendWindow)
+	w.New(new(Mux), 1)
+	w.SetSize(1<<33, 4096)
+	w.SetSize(1<<33, 4096) // duplicated
+	w.SetSize(1<<32, 8192) // out of order
+	if w.limit != 1<<33+4096 || w.acked != 1<<33 {
+		t.Fatal("wrong window", w.limit, w.acked)
+	}
+	w.sent = 1<<33 + 1000
+	if n := w.remainingSize(); n != 3096 {
+		t.Fatal("wrong remaining size", n)
+	}
+	// the old peers update the window by the size read since the last update, in the 13 bytes frame
+	pack = muxPack.Get()
+	if err := pack.Set(muxMsgSendOk, 1, packLegacyWindow(8192, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pack.Pack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 13 {
+		t.Fatal("wrong old window update length", buf.Len())
+	}
+	if _, err := pack.UnPack(buf); err != nil {
+		t.Fatal(err)
+	}
+	maxSize, read := unpackLegacyWindow(pack.window)
+	muxPack.Put(pack)
+	w.SetLegacySize(maxSize, read)
+	if w.acked != 1<<33+1000 || w.limit != 1<<33+1000+8192 {
+		t.Fatal("wrong window of the old update", w.limit, w.acked)
+	}
+}
+
+// dropConn drop the frames written if drop returns true
+type dropConn struct {
+	net.Conn
+	pw *io.PipeWriter
+}
+
+func newDropConn(c net.Conn, drop func(pack *muxPackager) bool) *dropConn {
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			pack := muxPack.Get()
+			if _, err := pack.UnPack(pr); err != nil {
+				return
+			}
+			if drop(pack) {
+				if pack.content != nil {
+					windowBuff.Put(pack.content)
+				}
+				muxPack.Put(pack)
+				continue
+			}
+			pack.buf = windowBuff.Get() // UnPack put the header buffer back to the pool, packing into it is a use after put
+			err := pack.Pack(c)
+			muxPack.Put(pack)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return &dropConn{Conn: c, pw: pw}
+}
+
+func (c *dropConn) Write(b []byte) (int, error) {
+	return c.pw.Write(b)
+}
+
+func (c *dropConn) Close() error {
+	_ = c.pw.Close()
+	return c.Conn.Close()
+}
+
+// readDropConn drop the frames read if drop returns true
+type readDropConn struct {
+	net.Conn
+	pr *io.PipeReader
+}
+
+func newReadDropConn(c net.Conn, drop func(pack *muxPackager) bool) *readDropConn {
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			pack := muxPack.Get()
+			if _, err := pack.UnPack(c); err != nil {
+				_ = pw.CloseWithError(err)
+				return
+			}
+			if drop(pack) {
+				if pack.content != nil {
+					windowBuff.Put(pack.content)
+				}
+				muxPack.Put(pack)
+				continue
+			}
+			pack.buf = windowBuff.Get() // UnPack put the header buffer back to the pool
+			err := pack.Pack(pw)
+			muxPack.Put(pack)
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return &readDropConn{Conn: c, pr: pr}
+}
+
+func (c *readDropConn) Read(b []byte) (int, error) {
+	return c.pr.Read(b)
+}
+
+func (c *readDropConn) Close() error {
+	_ = c.pr.Close()
+	return c.Conn.Close()
+}
+
+func TestWindowUpdateOldPeer(t *testing.T) {
+	var fc *frameCountConn
+	capabilities := func(pack *muxPackager) bool {
+		return pack.flag == muxCapabilities
+	}
+	// both sides never receive the capabilities, like the remote side is an old peer
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		return newReadDropConn(c, capabilities)
+	}, func(c net.Conn) net.Conn {
+		return newDropConn(c, capabilities)
+	}, func(c net.Conn) net.Conn {
+		fc = newFrameCountConn(c)
+		return fc
+	})
+	defer m1.Close()
+	defer m2.Close()
+	const size = 8 << 20
+	received := make(chan int64, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, c)
+		received <- n
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(time.Second * 5))
+	if _, err = c.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatal("wrong size received", n)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("stream stalled")
+	}
+	if n := atomic.LoadUint64(&fc.read[muxWindowUpdate]) + atomic.LoadUint64(&fc.read[muxSessionWindow]); n != 0 {
+		t.Fatal("new window frames sent to the old peer", n)
+	}
+	if atomic.LoadUint64(&fc.read[muxMsgSendOk]) == 0 {
+		t.Fatal("no window update of the old format")
+	}
+}
+
+func TestWindowProbe(t *testing.T) {
+	var dropped int32
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		return newDropConn(c, func(pack *muxPackager) bool {
+			// lost the stream window updates, and the updates advertised for the first probe
+			return pack.flag == muxWindowUpdate && atomic.AddInt32(&dropped, 1) <= 5
+		})
+	})
+	defer m1.Close()
+	defer m2.Close()
+	const size = 1 << 20
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = c.Write(make([]byte, size))
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 10))
+	n, err := io.ReadFull(c, make([]byte, size))
+	if err != nil {
+		t.Fatal("stream not recovered", n, err)
+	}
+	if atomic.LoadInt32(&dropped) <= 5 {
+		t.Fatal("window updates not dropped", dropped)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	const readBuffer, writeBuffer = MinReadBuffer + 8<<10, 32 << 10
+	accepted := make(chan *conn, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.(*conn)
+	}()
+	c1, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	if err = c1.SetReadBuffer(MinReadBuffer - 1); err == nil {
+		t.Fatal("read buffer smaller than the initial window accepted")
+	}
+	if err = c1.SetReadBuffer(readBuffer); err != nil {
+		t.Fatal(err)
+	}
+	if err = c2.SetWriteBuffer(writeBuffer); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = c2.Write(make([]byte, 4<<20))
+	}()
+	time.Sleep(time.Millisecond * 300)
+	if sent := atomic.LoadUint64(&c2.sendWindow.sent); sent > writeBuffer {
+		t.Fatal("unacknowledged bytes exceed the write buffer", sent)
+	}
+	_ = c2.SetWriteBuffer(maximumWindowSize)
+	if _, err = io.ReadFull(c1, make([]byte, 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 300)
+	if n := c1.receiveWindow.bufQueue.Len(); n > readBuffer {
+		t.Fatal("buffered bytes exceed the read buffer", n)
+	}
+}
+
+func TestNoDelay(t *testing.T) {
+	var fc *frameCountConn
+	m1, m2 := newMuxPair(t, func(c net.Conn) net.Conn {
+		fc = newFrameCountConn(c)
+		return fc
+	})
+	defer m1.Close()
+	defer m2.Close()
+	const writes, size = 1000, 10
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		b := make([]byte, writes*size)
+		_, _ = io.ReadFull(c, b)
+		received <- b
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetNoDelay(false)
+	for i := 0; i < writes; i++ {
+		if _, err = c.Write(bytes.Repeat([]byte{byte(i)}, size)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	b := <-received
+	for i := 0; i < writes; i++ {
+		if b[i*size] != byte(i) {
+			t.Fatal("wrong data at", i*size)
+		}
+	}
+	time.Sleep(time.Millisecond * 10)
+	frames := atomic.LoadUint64(&fc.written[muxNewMsg]) + atomic.LoadUint64(&fc.written[muxNewMsgPart])
+	log.Println("writes", writes, "data frames", frames)
+	if frames > writes/10 {
+		t.Fatal("small writes not coalesced", frames)
+	}
+	// the last write is sent after the delay without flush
+	if _, err = c.Write([]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(coalesceDelay * 4)
+	if n := atomic.LoadUint64(&fc.written[muxNewMsg]) + atomic.LoadUint64(&fc.written[muxNewMsgPart]); n != frames+1 {
+		t.Fatal("buffered write not sent after the delay", n)
+	}
+}
+
+func TestNoDelayCloseZeroWindow(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m2.Close()
+	go func() {
+		for {
+			if _, err := m2.Accept(); err != nil {
+				return
+			}
+			// never read, the windows of the streams are used up
+		}
+	}()
+	full := func() *conn {
+		c, err := m1.NewConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetNoDelay(false)
+		go func() {
+			b := make([]byte, 100)
+			for {
+				if _, err := c.Write(b); err != nil {
+					return
+				}
+			}
+		}()
+		for i := 0; c.sendWindow.remainingSize() > 0; i++ {
+			if i == 200 {
+				t.Fatal("the window is not used up")
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		time.Sleep(coalesceDelay * 2) // the delayed flush is waiting for the window
+		return c
+	}
+	closed := func(closeFunc func() error) bool {
+		done := make(chan struct{})
+		go func() {
+			_ = closeFunc()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(time.Second * 2):
+			return false
+		}
+	}
+	c := full()
+	_ = c.SetWriteDeadline(time.Now().Add(time.Millisecond * 100))
+	if !closed(c.Close) {
+		t.Fatal("stream close blocked by the flush after the write deadline")
+	}
+	full()
+	if !closed(m1.Close) {
+		t.Fatal("mux close blocked by the flush of the stream")
+	}
+}
+
+func TestStreamMessageCoalesced(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_ = c.(*conn).SetNoDelay(false)
+		for i := 0; i < 3; i++ {
+			_, _ = c.Write([]byte("abc"))
+			_ = c.(*conn).WriteMessage([]byte("message"))
+		}
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(time.Second * 5))
+	for i := 0; i < 3; i++ {
+		// the coalesced writes may be split, but never merged with the message
+		var data []byte
+		for len(data) < len("abc") {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append(data, msg...)
+		}
+		if string(data) != "abc" {
+			t.Fatal("coalesced writes merged with the message", string(data))
+		}
+		msg, err := c.ReadMessage()
+		if err != nil || string(msg) != "message" {
+			t.Fatal("wrong message after the coalesced writes", string(msg), err)
+		}
+	}
+}
+
+func TestReadFromClose(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, c)
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetNoDelay(false)
+	if _, err = c.Write([]byte("coalesced")); err != nil {
+		t.Fatal(err)
+	}
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	copied := make(chan error, 1)
+	go func() {
+		_, err := c.ReadFrom(pr)
+		copied <- err
+	}()
+	if _, err = pw.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; c.Stats().BytesWritten < uint64(len("coalesced")+len("data")); i++ {
+		if i == 200 {
+			t.Fatal("the data of ReadFrom not sent")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	// ReadFrom is blocked on the idle source now
+	done := make(chan struct{})
+	go func() {
+		_ = c.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("close blocked by the ReadFrom waiting for its source")
+	}
+	go func() {
+		_, _ = pw.Write([]byte("after close"))
+	}()
+	select {
+	case err = <-copied:
+		if err == nil {
+			t.Fatal("ReadFrom succeeded after the close")
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("ReadFrom not returned after the close")
+	}
+}
+
+func TestStreamMessage(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	sizes := []int{1, 100, maximumSegmentSize, maximumSegmentSize + 1, 100000}
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		for i, size := range sizes {
+			_ = c.(*conn).WriteMessage(bytes.Repeat([]byte{byte(i)}, size))
+		}
+		_ = c.(*conn).WriteMessage(make([]byte, 10000)) // too large for the reader
+		_ = c.(*conn).WriteMessage([]byte("end"))
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, size := range sizes {
+		msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(msg, bytes.Repeat([]byte{byte(i)}, size)) {
+			t.Fatal("wrong message", i, len(msg))
+		}
+	}
+	_ = c.SetMaxMessageSize(1000)
+	if _, err = c.ReadMessage(); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatal("too large message not discarded", err)
+	}
+	if err = c.WriteMessage(make([]byte, 1001)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatal("too large message written", err)
+	}
+	msg, err := c.ReadMessage()
+	if err != nil || string(msg) != "end" {
+		t.Fatal("wrong message after the discarded one", string(msg), err)
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	data := make([]byte, 1<<20+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		var buf bytes.Buffer
+		// WriteTo returns at the remote close, like io.Copy
+		_, _ = c.(io.WriterTo).WriteTo(&buf)
+		received <- buf.Bytes()
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// hide the bytes.Reader WriteTo, so the conn ReadFrom is used
+	n, err := c.ReadFrom(struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) {
+		t.Fatal("ReadFrom", n, err)
+	}
+	_ = c.Close()
+	select {
+	case buf := <-received:
+		if !bytes.Equal(buf, data) {
+			t.Fatal("wrong data", len(buf))
+		}
+	case <-time.After(time.Second * 10):
+		t.Fatal("WriteTo not returned")
+	}
+}
+
+func BenchmarkProxy(b *testing.B) {
+	m1, m2 := newMuxPair(b)
+	defer m1.Close()
+	defer m2.Close()
+	const size = 64 << 10
+	// the tcp source -> mux stream -> tcp sink, both sides use io.Copy like a proxy
+	src, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer src.Close()
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sink.Close()
+	go func() {
+		c, err := src.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		buf := make([]byte, size)
+		for i := 0; i < b.N; i++ {
+			if _, err = c.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+	done := make(chan int64, 1)
+	go func() {
+		c, err := sink.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		n, _ := io.Copy(ioutil.Discard, c)
+		done <- n
+	}()
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		out, err := net.Dial("tcp", sink.Addr().String())
+		if err != nil {
+			return
+		}
+		defer out.Close()
+		_, _ = io.Copy(out, c)
+	}()
+	in, err := net.Dial("tcp", src.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer in.Close()
+	b.SetBytes(size)
+	b.ResetTimer()
+	c, err := m1.NewConn()
+	if err != nil {
+		b.Fatal(err)
+	}
+	_, _ = io.Copy(c, in)
+	_ = c.Close()
+	if n := <-done; n != int64(size*b.N) {
+		b.Fatal("lost data", n)
+	}
+}
+
+func TestMuxStats(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	const size = 100000
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.CopyN(ioutil.Discard, c, size)
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = m1.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	stats := m1.Stats()
+	if stats.ActiveStreams != 1 || stats.TotalStreams != 1 || stats.RefusedStreams != 0 {
+		t.Fatal("wrong streams", stats.ActiveStreams, stats.TotalStreams, stats.RefusedStreams)
+	}
+	data := stats.SentFrames["new_msg"]
+	part := stats.SentFrames["new_msg_part"]
+	data.Frames += part.Frames
+	data.Bytes += part.Bytes
+	if data.Bytes < size || data.Bytes > size+data.Frames*7 {
+		t.Fatal("wrong data sent", data)
+	}
+	if stats.SentFrames["new_conn"].Frames != 1 || stats.ReceivedFrames["new_conn_ok"].Frames != 1 {
+		t.Fatal("wrong stream frames", stats.SentFrames["new_conn"], stats.ReceivedFrames["new_conn_ok"])
+	}
+	if stats.ReceivedFrames["window_update"].Frames == 0 || stats.ReceivedFrames["ping_return"].Frames == 0 {
+		t.Fatal("control frames not counted")
+	}
+	if stats.Received.Bytes < stats.ReceivedFrames["window_update"].Bytes || stats.RTT.Last == 0 || stats.Uptime <= 0 {
+		t.Fatal("wrong stats", stats)
+	}
+	remote := m2.Stats()
+	if remote.ReceivedFrames["new_msg"] != stats.SentFrames["new_msg"] || remote.ReceivedFrames["new_msg_part"] != part ||
+		remote.TotalStreams != 1 {
+		t.Fatal("remote side not match", remote.ReceivedFrames["new_msg"], stats.SentFrames["new_msg"])
+	}
+	if stats.Queue != (QueueStats{}) {
+		t.Fatal("write queue not drained", stats.Queue)
+	}
+	_ = c.Close()
+	time.Sleep(time.Millisecond * 100)
+	if n := m1.Stats().ActiveStreams; n != 0 {
+		t.Fatal("stream not closed", n)
+	}
+}
+
+func TestStreamStats(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	const size = 1 << 20
+	accepted := make(chan *conn, 1)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- c.(*conn)
+	}()
+	c1, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2 := <-accepted
+	written := make(chan error, 1)
+	go func() {
+		_, err := c1.Write(make([]byte, size))
+		written <- err
+	}()
+	time.Sleep(time.Millisecond * 300)
+	// the remote side is not reading, the writer waits for the window
+	stats := c1.Stats()
+	if stats.SendAvailable != 0 || stats.SendBlocked == 0 || stats.BytesWritten != stats.RemoteLimit ||
+		stats.BytesAcked != 0 {
+		t.Fatal("writer not blocked by the window", stats)
+	}
+	remote := c2.Stats()
+	if remote.BytesReceived != stats.BytesWritten || remote.Queued != uint32(remote.BytesReceived) || remote.BytesRead != 0 {
+		t.Fatal("wrong receive state", remote)
+	}
+	if _, err = io.ReadFull(c2, make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-written; err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	stats, remote = c1.Stats(), c2.Stats()
+	if stats.BytesWritten != size || stats.BytesAcked != size || remote.BytesRead != size || remote.Queued != 0 {
+		t.Fatal("wrong stats after read", stats, remote)
+	}
+	if remote.ReadBlocked == 0 || stats.RemoteWindow != remote.ReceiveWindow || stats.RemoteLimit != remote.ReceiveLimit {
+		t.Fatal("windows not match", stats, remote)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m2.Close()
+	registry := NewMetricsRegistry()
+	if err := registry.Register(m1, `client "a"`); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(m2, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := registry.Register(m2, `client "a"`); err == nil {
+		t.Fatal("two muxes registered with the same name")
+	}
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, c)
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(make([]byte, 100000)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	scrape := func() map[string]float64 {
+		server := httptest.NewServer(registry)
+		defer server.Close()
+		resp, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Fatal("wrong content type", resp.Header.Get("Content-Type"))
+		}
+		samples := make(map[string]float64)
+		families := make(map[string]bool)
+		sample := regexp.MustCompile(`^([a-z_]+)(\{.*\})? (\S+)$`)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if strings.HasPrefix(line, "# TYPE ") {
+				name := strings.Fields(line)[2]
+				if families[name] {
+					t.Fatal("family written twice", name)
+				}
+				families[name] = true
+				continue
+			}
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			match := sample.FindStringSubmatch(line)
+			if match == nil || !families[match[1]] {
+				t.Fatal("wrong sample", line)
+			}
+			v, err := strconv.ParseFloat(match[3], 64)
+			if err != nil {
+				t.Fatal("wrong value", line)
+			}
+			samples[match[1]+match[2]] = v
+		}
+		return samples
+	}
+	samples := scrape()
+	if samples["npsmux_muxes"] != 2 || samples["npsmux_streams_active"] != 2 || samples["npsmux_streams_total"] != 2 {
+		t.Fatal("wrong streams", samples["npsmux_muxes"], samples["npsmux_streams_active"], samples["npsmux_streams_total"])
+	}
+	sent := samples[`npsmux_frame_bytes_sent_total{type="new_msg"}`] + samples[`npsmux_frame_bytes_sent_total{type="new_msg_part"}`]
+	if sent < 100000 {
+		t.Fatal("data not counted", sent)
+	}
+	if v, ok := samples[`npsmux_mux_bytes_sent_total{mux="client \"a\""}`]; !ok || v < 100000 {
+		t.Fatal("named mux not exported", v)
+	}
+	if samples["npsmux_pool_gets_total"] == 0 {
+		t.Fatal("pool not exported")
+	}
+	_ = m1.Close() // m2 is closed too by the connection closed
+	time.Sleep(time.Millisecond * 100)
+	after := scrape()
+	if after["npsmux_muxes"] != 0 || after["npsmux_streams_total"] != 2 {
+		t.Fatal("closed mux not dropped", after["npsmux_muxes"], after["npsmux_streams_total"])
+	}
+	if v := after[`npsmux_frame_bytes_sent_total{type="new_msg"}`] + after[`npsmux_frame_bytes_sent_total{type="new_msg_part"}`]; v < sent {
+		t.Fatal("counter decreased after the mux closed", v, sent)
+	}
+	if _, ok := after[`npsmux_mux_bytes_sent_total{mux="client \"a\""}`]; ok {
+		t.Fatal("closed mux still exported")
+	}
+	m3, m4 := newMuxPair(t)
+	defer m3.Close()
+	defer m4.Close()
+	if err := registry.Register(m3, `client "a"`); err != nil {
+		t.Fatal("the name of the closed mux not reused", err)
+	}
+}
+
+type recordTracer struct {
+	sent     []FrameInfo
+	received []FrameInfo
+	states   []string
+	windows  []WindowEvent
+	sync.Mutex
+}
+
+func (r *recordTracer) FrameSent(frame FrameInfo) {
+	r.Lock()
+	r.sent = append(r.sent, frame)
+	r.Unlock()
+}
+
+func (r *recordTracer) FrameReceived(frame FrameInfo) {
+	r.Lock()
+	r.received = append(r.received, frame)
+	r.Unlock()
+}
+
+func (r *recordTracer) StreamStateChanged(stream int32, state StreamState) {
+	r.Lock()
+	r.states = append(r.states, fmt.Sprint(stream, state))
+	r.Unlock()
+}
+
+func (r *recordTracer) WindowChanged(event WindowEvent) {
+	r.Lock()
+	r.windows = append(r.windows, event)
+	r.Unlock()
+}
+
+func TestTracer(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	t1, t2 := new(recordTracer), new(recordTracer)
+	m1.SetTracer(t1)
+	m2.SetTracer(t2)
+	const size = 500000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(ioutil.Discard, c)
+		_ = c.Close()
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(make([]byte, size)); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.Close()
+	<-done
+	time.Sleep(time.Millisecond * 100)
+	t1.Lock()
+	t2.Lock()
+	sent, received, windows, remoteWindows := t1.sent, t2.received, t1.windows, t2.windows
+	states, remoteStates := fmt.Sprint(t1.states), fmt.Sprint(t2.states)
+	t1.Unlock()
+	t2.Unlock()
+	if states != "[1 opening 1 opened 1 closed]" {
+		t.Fatal("wrong stream states", states)
+	}
+	if remoteStates != "[1 opening 1 opened 1 closing 1 closed]" {
+		t.Fatal("wrong remote stream states", remoteStates)
+	}
+	var data int
+	for _, frame := range sent {
+		if isData(frame.Flag) {
+			if frame.Stream != c.connId || frame.Type[:7] != "new_msg" {
+				t.Fatal("wrong frame", frame)
+			}
+			data += int(frame.Length)
+		}
+	}
+	if data != size || len(received) < len(sent) {
+		t.Fatal("frames not traced", data, len(sent), len(received))
+	}
+	var advertised, updated int
+	for _, event := range remoteWindows {
+		if event.Stream == c.connId && event.Receive {
+			advertised++
+		}
+	}
+	for _, event := range windows {
+		if event.Stream == c.connId && !event.Receive {
+			if event.Limit < initialWindowSize {
+				t.Fatal("wrong window", event)
+			}
+			updated++
+		}
+	}
+	if advertised == 0 || updated == 0 {
+		t.Fatal("window changes not traced", advertised, updated)
+	}
+	m1.SetTracer(nil)
+	if _, err = m1.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t1.Lock()
+	defer t1.Unlock()
+	if len(t1.sent) != len(sent) {
+		t.Fatal("tracer not removed")
+	}
+}
+
+func TestCapture(t *testing.T) {
+	m1, m2 := newMuxPair(t)
+	defer m1.Close()
+	defer m2.Close()
+	capture := new(bytes.Buffer)
+	if err := m1.StartCapture(capture, 16); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	go func() {
+		c, err := m2.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(c, c) // echo
+	}()
+	c, err := m1.NewConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(c, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if err = m1.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewCaptureReader(capture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent, received int
+	var last time.Time
+	var window bool
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Time.Before(last) {
+			t.Fatal("time goes back", frame.Time, last)
+		}
+		last = frame.Time
+		if isData(frame.Flag) {
+			if frame.Stream != c.connId || len(frame.Payload) != 16 {
+				t.Fatal("wrong data frame", frame.FrameInfo, string(frame.Payload))
+			}
+			if frame.Sent {
+				sent += int(frame.Length)
+			} else {
+				received += int(frame.Length)
+			}
+		}
+		if frame.Type == "window_update" && frame.Size > 0 {
+			window = true
+		}
+	}
+	if sent != len(data) || received != len(data) || !window {
+		t.Fatal("frames not captured", sent, received, window)
+	}
+	if _, err = NewCaptureReader(bytes.NewReader(data)); err == nil {
+		t.Fatal("not a capture file")
+	}
+	// the raw stream in the wire format
+	raw := new(bytes.Buffer)
+	for _, v := range []struct {
+		flag    uint8
+		content interface{}
+	}{
+		{muxNewMsg, data[:100]},
+		{muxWindowUpdate, windowUpdate{offset: 100, size: 4096}},
+		{muxMsgSendOk, packLegacyWindow(4096, 100)},
+		{muxSessionWindow, uint64(1 << 20)},
+		{muxConnClose, nil},
+	} {
+		pack := muxPack.Get()
+		if err = pack.Set(v.flag, 3, v.content); err != nil {
+			t.Fatal(err)
+		}
+		if err = pack.Pack(raw); err != nil {
+			t.Fatal(err)
+		}
+		muxPack.Put(pack)
+	}
+	fr := NewFrameReader(raw)
+	var frames []string
+	for {
+		frame, err := fr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, fmt.Sprint(frame.Type, frame.Stream, frame.Length, frame.Window, frame.Size, len(frame.Payload)))
+	}
+	if fmt.Sprint(frames) != "[new_msg3 100 0 0 100 window_update3 0 100 4096 0 msg_send_ok3 0 100 4096 0 session_window3 0 1048576 0 0 conn_close3 0 0 0 0]" {
+		t.Fatal("wrong raw frames", frames)
+	}
+}
@@ -80,10 +80,61 @@ func (Self *basePackager) reset() {
 	Self.content = Self.content[:0] // reset length
 }
 
+// hasContent reports whether frames with the flag carry a length prefixed content.
+// the old peers read the unknown flags as header only frames, they can't skip the content,
+// so a new content frame is only sent after the remote side announced it,
+// by muxFrameRegister for the extension frames, by muxCapabilities for the others
+func hasContent(flag uint8) bool {
+	switch flag {
+	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn, muxSessionMsg, muxSessionMsgPart,
+		muxDatagram:
+		return true
+	}
+	return flag >= ExtensionFlagMin
+}
+
+// hasWindow reports whether frames with the flag carry a 64 bits window
+func hasWindow(flag uint8) bool {
+	return flag == muxMsgSendOk || flag == muxSessionWindow
+}
+
+// hasWindowSize reports whether frames with the flag carry a 32 bits window size after the window
+func hasWindowSize(flag uint8) bool {
+	return flag == muxWindowUpdate
+}
+
+// windowUpdate is the content of muxWindowUpdate,
+// the absolute offset of the stream data receive window consumed, and the max size of the window
+type windowUpdate struct {
+	offset uint64
+	size   uint32
+}
+
+// the window of muxMsgSendOk, the window update of the old peers, contains 4 parts
+//
+//	1       31       1      31
+//	wait  maxSize  useless  read
+//
+// read is the size read since the last update
+const (
+	legacyReadBits = 32
+	legacyMask31   = 1<<31 - 1
+)
+
+func packLegacyWindow(maxSize, read uint32) uint64 {
+	return uint64(maxSize&legacyMask31)<<legacyReadBits | uint64(read&legacyMask31)
+}
+
+func unpackLegacyWindow(window uint64) (maxSize, read uint32) {
+	return uint32(window>>legacyReadBits) & legacyMask31, uint32(window) & legacyMask31
+}
+
 type muxPackager struct {
-	flag   uint8
-	id     int32
-	window uint64
+	flag     uint8
+	priority uint8 // stream priority, only used in write queue
+	id       int32
+	window   uint64
+	size     uint32
 	basePackager
 }
 
@@ -91,26 +142,42 @@ func (Self *muxPackager) Set(flag uint8, id int32, content interface{}) (err err
 	Self.buf = windowBuff.Get()
 	Self.flag = flag
 	Self.id = id
-	switch flag {
-	case muxPingFlag, muxPingReturn, muxNewMsg, muxNewMsgPart:
+	switch {
+	case hasContent(flag):
 		Self.content = windowBuff.Get()
 		err = Self.basePackager.Set(content.([]byte))
-	case muxMsgSendOk:
-		// MUX_MSG_SEND_OK contains one data
+	case hasWindowSize(flag):
+		update := content.(windowUpdate)
+		Self.window = update.offset
+		Self.size = update.size
+	case hasWindow(flag):
 		Self.window = content.(uint64)
 	}
 	return
 }
 
+// SetContent Set the content frame with the buffer from windowBuff, the buffer is owned by the packager, no copy
+func (Self *muxPackager) SetContent(flag uint8, id int32, content []byte) {
+	Self.buf = windowBuff.Get()
+	Self.flag = flag
+	Self.id = id
+	Self.content = content
+	Self.setLength()
+}
+
 func (Self *muxPackager) Pack(writer io.Writer) (err error) {
-	Self.buf = Self.buf[0:13]
+	Self.buf = Self.buf[0:17]
 	Self.buf[0] = byte(Self.flag)
 	binary.LittleEndian.PutUint32(Self.buf[1:5], uint32(Self.id))
-	switch Self.flag {
-	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn:
+	switch {
+	case hasContent(Self.flag):
 		err = Self.basePackager.Pack(writer)
 		windowBuff.Put(Self.content)
-	case muxMsgSendOk:
+	case hasWindowSize(Self.flag):
+		binary.LittleEndian.PutUint64(Self.buf[5:13], Self.window)
+		binary.LittleEndian.PutUint32(Self.buf[13:17], Self.size)
+		_, err = writer.Write(Self.buf[:17])
+	case hasWindow(Self.flag):
 		binary.LittleEndian.PutUint64(Self.buf[5:13], Self.window)
 		_, err = writer.Write(Self.buf[:13])
 	default:
@@ -120,9 +187,22 @@ func (Self *muxPackager) Pack(writer io.Writer) (err error) {
 	return
 }
 
+// frameSize is the bytes of the frame on the wire
+func (Self *muxPackager) frameSize() uint32 {
+	switch {
+	case hasContent(Self.flag):
+		return 7 + uint32(Self.length)
+	case hasWindowSize(Self.flag):
+		return 17
+	case hasWindow(Self.flag):
+		return 13
+	}
+	return 5
+}
+
 func (Self *muxPackager) UnPack(reader io.Reader) (n uint16, err error) {
 	Self.buf = windowBuff.Get()
-	Self.buf = Self.buf[0:13]
+	Self.buf = Self.buf[0:17]
 	l, err := io.ReadFull(reader, Self.buf[:5])
 	if err != nil {
 		return
@@ -130,13 +210,18 @@ func (Self *muxPackager) UnPack(reader io.Reader) (n uint16, err error) {
 	n += uint16(l)
 	Self.flag = uint8(Self.buf[0])
 	Self.id = int32(binary.LittleEndian.Uint32(Self.buf[1:5]))
-	switch Self.flag {
-	case muxNewMsg, muxNewMsgPart, muxPingFlag, muxPingReturn:
+	switch {
+	case hasContent(Self.flag):
 		var m uint16
 		Self.content = windowBuff.Get() // need Get a window buf from pool
 		m, err = Self.basePackager.UnPack(reader)
 		n += m
-	case muxMsgSendOk:
+	case hasWindowSize(Self.flag):
+		l, err = io.ReadFull(reader, Self.buf[5:17])
+		Self.window = binary.LittleEndian.Uint64(Self.buf[5:13])
+		Self.size = binary.LittleEndian.Uint32(Self.buf[13:17])
+		n += uint16(l) // uint64 and uint32
+	case hasWindow(Self.flag):
 		l, err = io.ReadFull(reader, Self.buf[5:13])
 		Self.window = binary.LittleEndian.Uint64(Self.buf[5:13])
 		n += uint16(l) // uint64
@@ -148,8 +233,10 @@ func (Self *muxPackager) UnPack(reader io.Reader) (n uint16, err error) {
 func (Self *muxPackager) reset() {
 	Self.id = 0
 	Self.flag = 0
+	Self.priority = 0
 	Self.length = 0
 	Self.content = nil
 	Self.window = 0
+	Self.size = 0
 	Self.buf = nil
 }
@@ -0,0 +1,153 @@
+package nps_mux
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pingInterval    = time.Second * 5
+	pingPayloadSize = 8 // the sequence id of the probe, the remote side return it as it is
+)
+
+type pingProbe struct {
+	sent time.Time
+	ch   chan time.Duration // nil for the keepalive probes
+}
+
+// pinger match the ping returns to the probes by sequence id
+type pinger struct {
+	seq      uint64
+	failures uint64 // the probes not answered in time
+	lastRecv int64  // unix nano of the last frame received
+	idle     int64  // keepalive only probe after the mux is idle so long, zero means always
+	floor    int64  // bounds of the liveness timeout
+	ceiling  int64
+	timer    *time.Timer // the pending liveness check
+	deadline time.Time
+	probes   map[uint64]pingProbe
+	sync.Mutex
+}
+
+func newPinger(ceiling time.Duration) *pinger {
+	if ceiling < defaultLivenessFloor {
+		ceiling = defaultLivenessFloor
+	}
+	return &pinger{
+		lastRecv: time.Now().UnixNano(),
+		floor:    int64(defaultLivenessFloor),
+		ceiling:  int64(ceiling),
+		probes:   make(map[uint64]pingProbe),
+	}
+}
+
+func (Self *pinger) add(ch chan time.Duration) (seq uint64, payload []byte) {
+	Self.Lock()
+	Self.seq++
+	seq = Self.seq
+	Self.probes[seq] = pingProbe{sent: time.Now(), ch: ch}
+	Self.Unlock()
+	payload = make([]byte, pingPayloadSize)
+	binary.LittleEndian.PutUint64(payload, seq)
+	return
+}
+
+func (Self *pinger) remove(seq uint64) {
+	Self.Lock()
+	delete(Self.probes, seq)
+	Self.Unlock()
+}
+
+func (Self *pinger) done(payload []byte) (rtt time.Duration, ok bool) {
+	if len(payload) != pingPayloadSize {
+		return
+	}
+	seq := binary.LittleEndian.Uint64(payload)
+	Self.Lock()
+	probe, ok := Self.probes[seq]
+	delete(Self.probes, seq)
+	Self.Unlock()
+	if !ok {
+		return
+	}
+	rtt = time.Since(probe.sent)
+	if probe.ch != nil {
+		probe.ch <- rtt
+	}
+	return
+}
+
+// expire drop the probes sent before the time, they are counted as failures
+func (Self *pinger) expire(before time.Time) {
+	Self.Lock()
+	for seq, probe := range Self.probes {
+		if probe.ch == nil && probe.sent.Before(before) {
+			delete(Self.probes, seq)
+			atomic.AddUint64(&Self.failures, 1)
+		}
+	}
+	Self.Unlock()
+}
+
+func (Self *pinger) received() {
+	atomic.StoreInt64(&Self.lastRecv, time.Now().UnixNano())
+}
+
+func (Self *pinger) isIdle() bool {
+	idle := atomic.LoadInt64(&Self.idle)
+	return idle == 0 || time.Now().UnixNano()-atomic.LoadInt64(&Self.lastRecv) >= idle
+}
+
+// Ping send a probe to the remote side and returns the round trip time of it,
+// the result is also taken into the RTT statistics
+func (s *Mux) Ping(ctx context.Context) (time.Duration, error) {
+	if s.IsClose {
+		return 0, errors.New("the mux has closed")
+	}
+	ch := make(chan time.Duration, 1)
+	seq, payload := s.pinger.add(ch)
+	s.sendInfo(muxPingFlag, muxPing, payload)
+	s.checkLiveness()
+	select {
+	case rtt := <-ch:
+		return rtt, nil
+	case <-ctx.Done():
+		s.pinger.remove(seq)
+		if ctx.Err() == context.DeadlineExceeded {
+			atomic.AddUint64(&s.pinger.failures, 1)
+		}
+		return 0, ctx.Err()
+	case <-s.closeChan:
+		s.pinger.remove(seq)
+		return 0, errors.New("the mux has closed")
+	}
+}
+
+// SetKeepAlive Set the keepalive only probe after nothing received from the remote side for the idle duration,
+// it saves the bandwidth and battery of the mostly idle mux. zero means probe every 5 seconds, the default.
+// the mux is still closed if the probe not answered within the liveness timeout.
+func (s *Mux) SetKeepAlive(idle time.Duration) {
+	if idle < 0 {
+		idle = 0
+	}
+	atomic.StoreInt64(&s.pinger.idle, int64(idle))
+}
+
+func (s *Mux) sendPing() {
+	s.pinger.expire(time.Now().Add(-s.livenessTimeout()))
+	// the keepalive probes never answered
+	_, payload := s.pinger.add(nil)
+	s.sendInfo(muxPingFlag, muxPing, payload)
+	s.checkLiveness()
+}
+
+func (s *Mux) pingReturn(payload []byte) {
+	if rtt, ok := s.pinger.done(payload); ok {
+		s.rtt.Update(rtt)
+	}
+	windowBuff.Put(payload)
+}
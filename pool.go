@@ -2,6 +2,7 @@ package nps_mux
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -10,6 +11,8 @@ const (
 )
 
 type windowBufferPool struct {
+	gets uint64
+	puts uint64
 	pool sync.Pool
 }
 
@@ -35,12 +38,14 @@ func newWindowBufferPool() *windowBufferPool {
 
 func (Self *windowBufferPool) Get() (buf []byte) {
 	buf = Self.pool.Get().([]byte)
+	atomic.AddUint64(&Self.gets, 1)
 	//trace(buf, "get")
 	return buf[:poolSizeWindow]
 }
 
 func (Self *windowBufferPool) Put(x []byte) {
 	//trace(x, "put")
+	atomic.AddUint64(&Self.puts, 1)
 	Self.pool.Put(x[:poolSizeWindow]) // make buf to full
 }
 
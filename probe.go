@@ -0,0 +1,43 @@
+package nps_mux
+
+import (
+	"time"
+)
+
+// the sender waiting for the window probe the receiver after the interval,
+// in case the window update is lost, the interval doubles after every probe
+const (
+	minProbeInterval = time.Millisecond * 200
+	maxProbeInterval = time.Second * 5
+)
+
+func (s *Mux) probeInterval() time.Duration {
+	n := 2 * s.rtt.Smoothed()
+	if n < minProbeInterval {
+		n = minProbeInterval
+	}
+	if n > maxProbeInterval {
+		n = maxProbeInterval
+	}
+	return n
+}
+
+func nextProbeInterval(n time.Duration) time.Duration {
+	n *= 2
+	if n > maxProbeInterval {
+		n = maxProbeInterval
+	}
+	return n
+}
+
+// windowProbe advertise the windows again, the session window is always advertised,
+// a stream may wait for it too
+func (s *Mux) windowProbe(id int32) {
+	s.receiveBudget.Readvertise()
+	if id == sessionQueueId {
+		return
+	}
+	if connection, ok := s.connMap.Get(id); ok && !connection.isClose {
+		connection.receiveWindow.Readvertise(id)
+	}
+}
@@ -11,10 +11,22 @@ import (
 	"unsafe"
 )
 
+// the priority classes of the write queue, the stream frames are counted by the stream priority
+const (
+	queuePing uint8 = iota
+	queueControl
+	queueSession
+	queueStream
+	queueClasses = queueStream + priorityLevels
+)
+
 type priorityQueue struct {
+	depth        [queueClasses]int64 // frames queued in every class, first and the queue allocated alone for the 64 bits alignment
+	length       uint32              // content length queued in lowestChain
 	highestChain *bufChain
+	controlChain *bufChain
 	middleChain  *bufChain
-	lowestChain  *bufChain
+	lowestChain  streamScheduler
 	starving     uint8
 	stop         bool
 	cond         *sync.Cond
@@ -23,10 +35,11 @@ type priorityQueue struct {
 func (Self *priorityQueue) New() {
 	Self.highestChain = new(bufChain)
 	Self.highestChain.new(4)
+	Self.controlChain = new(bufChain)
+	Self.controlChain.new(32)
 	Self.middleChain = new(bufChain)
 	Self.middleChain.new(32)
-	Self.lowestChain = new(bufChain)
-	Self.lowestChain.new(256)
+	Self.lowestChain.New()
 	locker := new(sync.Mutex)
 	Self.cond = sync.NewCond(locker)
 }
@@ -39,15 +52,34 @@ func (Self *priorityQueue) Push(packager *muxPackager) {
 
 func (Self *priorityQueue) push(packager *muxPackager) {
 	switch packager.flag {
-	case muxPingFlag, muxPingReturn:
+	case muxPingFlag, muxPingReturn, muxCapabilities:
+		atomic.AddInt64(&Self.depth[queuePing], 1)
 		Self.highestChain.pushHead(unsafe.Pointer(packager))
 	// the ping package need highest priority
 	// prevent ping calculation error
-	case muxNewConn, muxNewConnOk, muxNewConnFail:
-		// the New conn package need some priority too
+	// the capabilities must be the first frame, ahead of the first ping
+	case muxMsgSendOk, muxWindowUpdate, muxSessionWindow, muxWindowProbe, muxSessionMsgRead:
+		atomic.AddInt64(&Self.depth[queueControl], 1)
+		Self.controlChain.pushHead(unsafe.Pointer(packager))
+		// window updates can't wait behind the bulk data, otherwise the other direction stalls
+	case muxConnClose:
+		atomic.AddInt64(&Self.depth[queueStream+packager.priority], 1)
+		if !Self.lowestChain.PushQueued(packager) {
+			atomic.AddInt64(&Self.depth[queueStream+packager.priority], -1)
+			atomic.AddInt64(&Self.depth[queueControl], 1)
+			Self.controlChain.pushHead(unsafe.Pointer(packager))
+		}
+		// the close must follow the stream data still queued
+	case muxNewConn, muxNewConnOk, muxNewConnFail, muxSessionMsg, muxSessionMsgPart:
+		// the New conn package need some priority too,
+		// session messages are control messages, can't wait behind the bulk data
+		atomic.AddInt64(&Self.depth[queueSession], 1)
 		Self.middleChain.pushHead(unsafe.Pointer(packager))
 	default:
-		Self.lowestChain.pushHead(unsafe.Pointer(packager))
+		atomic.AddUint32(&Self.length, uint32(packager.length))
+		atomic.AddInt64(&Self.depth[queueStream+packager.priority], 1)
+		Self.lowestChain.Push(packager)
+		// stream data and the other frames follow the stream data
 	}
 }
 
@@ -87,6 +119,13 @@ func (Self *priorityQueue) TryPop() (packager *muxPackager) {
 	ptr, ok := Self.highestChain.popTail()
 	if ok {
 		packager = (*muxPackager)(ptr)
+		atomic.AddInt64(&Self.depth[queuePing], -1)
+		return
+	}
+	ptr, ok = Self.controlChain.popTail()
+	if ok {
+		packager = (*muxPackager)(ptr)
+		atomic.AddInt64(&Self.depth[queueControl], -1)
 		return
 	}
 	if Self.starving < maxStarving {
@@ -94,13 +133,15 @@ func (Self *priorityQueue) TryPop() (packager *muxPackager) {
 		ptr, ok = Self.middleChain.popTail()
 		if ok {
 			packager = (*muxPackager)(ptr)
+			atomic.AddInt64(&Self.depth[queueSession], -1)
 			Self.starving++
 			return
 		}
 	}
-	ptr, ok = Self.lowestChain.popTail()
-	if ok {
-		packager = (*muxPackager)(ptr)
+	packager = Self.lowestChain.TryPop()
+	if packager != nil {
+		atomic.AddInt64(&Self.depth[queueStream+packager.priority], -1)
+		atomic.AddUint32(&Self.length, ^(uint32(packager.length) - 1))
 		if Self.starving > 0 {
 			Self.starving = Self.starving / 2
 		}
@@ -110,6 +151,7 @@ func (Self *priorityQueue) TryPop() (packager *muxPackager) {
 		ptr, ok = Self.middleChain.popTail()
 		if ok {
 			packager = (*muxPackager)(ptr)
+			atomic.AddInt64(&Self.depth[queueSession], -1)
 			Self.starving++
 			return
 		}
@@ -117,6 +159,23 @@ func (Self *priorityQueue) TryPop() (packager *muxPackager) {
 	return
 }
 
+func (Self *priorityQueue) Len() (n uint32) {
+	// content length waiting in lowestChain, most of them are stream data
+	return atomic.LoadUint32(&Self.length)
+}
+
+// Stats returns the frames queued in every priority class
+func (Self *priorityQueue) Stats() QueueStats {
+	return QueueStats{
+		Ping:    atomic.LoadInt64(&Self.depth[queuePing]),
+		Control: atomic.LoadInt64(&Self.depth[queueControl]),
+		Session: atomic.LoadInt64(&Self.depth[queueSession]),
+		High:    atomic.LoadInt64(&Self.depth[queueStream+PriorityHigh]),
+		Normal:  atomic.LoadInt64(&Self.depth[queueStream+PriorityNormal]),
+		Low:     atomic.LoadInt64(&Self.depth[queueStream+PriorityLow]),
+	}
+}
+
 func (Self *priorityQueue) Stop() {
 	Self.stop = true
 	Self.cond.Broadcast()
@@ -212,6 +271,7 @@ func newListElement(buf []byte, l uint16, part bool) (element *listElement, err
 
 type receiveWindowQueue struct {
 	lengthWait uint64
+	blocked    int64 // nanoseconds the reader waited for the data
 	chain      *bufChain
 	stopOp     chan struct{}
 	readOp     chan struct{}
@@ -299,7 +359,11 @@ func (Self *receiveWindowQueue) allowPop() (closed bool) {
 }
 
 func (Self *receiveWindowQueue) waitPush() (err error) {
-	t := Self.timeout.Sub(time.Now())
+	start := time.Now()
+	defer func() {
+		atomic.AddInt64(&Self.blocked, int64(time.Since(start)))
+	}()
+	t := Self.timeout.Sub(start)
 	if t <= 0 {
 		// not Set the timeout, so wait for it without timeout, just like a tcp connection
 		select {
@@ -0,0 +1,72 @@
+package nps_mux
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rttMinWindow is how long a min RTT sample is kept, the route of the connection may change
+const rttMinWindow = time.Minute * 5
+
+// RTTStats is the round trip time statistics of the mux connection,
+// smoothed RTT and variance are calculated like TCP retransmission timer, RFC 6298
+type RTTStats struct {
+	Smoothed time.Duration
+	Variance time.Duration
+	Min      time.Duration // the minimal sample of the last 5 minutes
+	Last     time.Duration // the latest sample
+}
+
+type rttEstimator struct {
+	smoothed int64 // store in nanoseconds, read it atomic without the lock
+	stats    RTTStats
+	minStamp time.Time
+	sync.Mutex
+}
+
+func newRttEstimator() *rttEstimator {
+	return new(rttEstimator)
+}
+
+func (Self *rttEstimator) Update(rtt time.Duration) {
+	if rtt <= 0 {
+		return
+	}
+	Self.Lock()
+	defer Self.Unlock()
+	now := time.Now()
+	if Self.stats.Smoothed == 0 {
+		// the first sample
+		Self.stats.Smoothed = rtt
+		Self.stats.Variance = rtt / 2
+	} else {
+		delta := Self.stats.Smoothed - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		Self.stats.Variance = (3*Self.stats.Variance + delta) / 4
+		Self.stats.Smoothed = (7*Self.stats.Smoothed + rtt) / 8
+	}
+	if Self.stats.Min == 0 || rtt <= Self.stats.Min || now.Sub(Self.minStamp) > rttMinWindow {
+		Self.stats.Min = rtt
+		Self.minStamp = now
+	}
+	Self.stats.Last = rtt
+	atomic.StoreInt64(&Self.smoothed, int64(Self.stats.Smoothed))
+}
+
+func (Self *rttEstimator) Smoothed() time.Duration {
+	return time.Duration(atomic.LoadInt64(&Self.smoothed))
+}
+
+func (Self *rttEstimator) Stats() RTTStats {
+	Self.Lock()
+	defer Self.Unlock()
+	return Self.stats
+}
+
+// RTT returns the round trip time statistics measured by ping, all zero if not measured yet
+func (s *Mux) RTT() RTTStats {
+	return s.rtt.Stats()
+}
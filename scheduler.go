@@ -0,0 +1,160 @@
+package nps_mux
+
+import (
+	"sync"
+)
+
+// stream priority levels, the write scheduler always serve the higher level streams first,
+// lower levels still get a frame out after maxStarving frames of the higher ones
+const (
+	PriorityLow uint8 = iota
+	PriorityNormal
+	PriorityHigh
+	priorityLevels
+)
+
+// sessionQueueId is the stream queue of the frames not belong to any stream,
+// stream id is never zero
+const sessionQueueId int32 = 0
+
+type packQueue struct {
+	packs []*muxPackager
+	head  int
+}
+
+func (Self *packQueue) Push(pack *muxPackager) {
+	Self.packs = append(Self.packs, pack)
+}
+
+func (Self *packQueue) Pop() (pack *muxPackager) {
+	pack = Self.packs[Self.head]
+	Self.packs[Self.head] = nil
+	Self.head++
+	if Self.head == len(Self.packs) {
+		Self.packs = Self.packs[:0]
+		Self.head = 0
+		// drained, reuse the slice from start
+	}
+	return
+}
+
+func (Self *packQueue) Peek() *muxPackager {
+	return Self.packs[Self.head]
+}
+
+func (Self *packQueue) Len() int {
+	return len(Self.packs) - Self.head
+}
+
+type streamQueue struct {
+	id       int32
+	priority uint8
+	deficit  int
+	packs    packQueue
+}
+
+// drrQuantum is the bytes a stream can send in one round,
+// it must be larger than the largest frame, so that every stream sends at least one frame per round
+const drrQuantum = maximumSegmentSize
+
+// streamScheduler keep the frames of every stream in its own queue,
+// so the frames of a stream never reorder, and a busy stream can't block the others.
+// streams in the same priority level are served by deficit round robin,
+// every stream get the same bytes in a round, no matter how large its frames are.
+type streamScheduler struct {
+	streams  map[int32]*streamQueue
+	active   [priorityLevels][]*streamQueue
+	starving [priorityLevels]uint8
+	sync.Mutex
+}
+
+func (Self *streamScheduler) New() {
+	Self.streams = make(map[int32]*streamQueue)
+}
+
+func (Self *streamScheduler) Push(pack *muxPackager) {
+	id := pack.id
+	if pack.flag == muxDatagram || pack.flag >= ExtensionFlagMin {
+		id = sessionQueueId
+	}
+	Self.Lock()
+	sq, ok := Self.streams[id]
+	if !ok {
+		sq = &streamQueue{id: id, priority: pack.priority}
+		Self.streams[id] = sq
+		Self.active[sq.priority] = append(Self.active[sq.priority], sq)
+	} else if isData(pack.flag) && pack.priority != sq.priority {
+		Self.remove(sq)
+		sq.priority = pack.priority
+		Self.active[sq.priority] = append(Self.active[sq.priority], sq)
+		// the stream changed priority, the queued frames follow it, never reorder
+	}
+	sq.packs.Push(pack)
+	Self.Unlock()
+}
+
+// PushQueued push the frame only if the stream still has frames queued
+func (Self *streamScheduler) PushQueued(pack *muxPackager) (ok bool) {
+	Self.Lock()
+	sq, ok := Self.streams[pack.id]
+	if ok {
+		sq.packs.Push(pack)
+	}
+	Self.Unlock()
+	return
+}
+
+func (Self *streamScheduler) remove(sq *streamQueue) {
+	list := Self.active[sq.priority]
+	for i, v := range list {
+		if v == sq {
+			Self.active[sq.priority] = append(list[:i], list[i+1:]...)
+			return
+		}
+	}
+}
+
+func (Self *streamScheduler) TryPop() (pack *muxPackager) {
+	Self.Lock()
+	defer Self.Unlock()
+	level := -1
+	for i := int(priorityLevels) - 1; i >= 0; i-- {
+		if len(Self.active[i]) == 0 {
+			continue
+		}
+		if level < 0 {
+			level = i
+			continue
+		}
+		// a lower level is waiting
+		Self.starving[i]++
+		if Self.starving[i] >= maxStarving {
+			level = i
+		}
+	}
+	if level < 0 {
+		return
+	}
+	Self.starving[level] = 0
+	list := Self.active[level]
+	sq := list[0]
+	for sq.deficit < int(sq.packs.Peek().length) {
+		sq.deficit += drrQuantum
+		list = append(list[1:], sq)
+		sq = list[0]
+		// the stream used up its quantum, move to the tail and serve the next one
+	}
+	pack = sq.packs.Pop()
+	sq.deficit -= int(pack.length)
+	if sq.packs.Len() == 0 {
+		list = list[1:]
+		delete(Self.streams, sq.id)
+		// drained, release the stream queue, an idle stream can't save the deficit
+	}
+	Self.active[level] = list
+	return
+}
+
+func isData(flag uint8) bool {
+	return flag == muxNewMsg || flag == muxNewMsgPart
+}
@@ -0,0 +1,181 @@
+package nps_mux
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// frameNames is the name of the frame types in Stats, extension frames are all counted as "extension"
+var frameNames = [muxFlags + 1]string{
+	muxPingFlag:       "ping",
+	muxNewConnOk:      "new_conn_ok",
+	muxNewConnFail:    "new_conn_fail",
+	muxNewMsg:         "new_msg",
+	muxNewMsgPart:     "new_msg_part",
+	muxMsgSendOk:      "msg_send_ok",
+	muxNewConn:        "new_conn",
+	muxConnClose:      "conn_close",
+	muxPingReturn:     "ping_return",
+	muxFrameRegister:  "frame_register",
+	muxSessionMsg:     "session_msg",
+	muxSessionMsgPart: "session_msg_part",
+	muxDatagram:       "datagram",
+	muxSessionWindow:  "session_window",
+	muxWindowProbe:    "window_probe",
+	muxCapabilities:   "capabilities",
+	muxWindowUpdate:   "window_update",
+	muxSessionMsgRead: "session_msg_read",
+	muxFlags:          "extension",
+}
+
+// FrameStats is the frames and bytes of a frame type, the bytes include the frame headers
+type FrameStats struct {
+	Frames uint64
+	Bytes  uint64
+}
+
+// QueueStats is the frames waiting in the write queue by priority class
+type QueueStats struct {
+	Ping    int64 // ping, ping return and capabilities
+	Control int64 // window updates, window probes, session messages read and closes of the idle streams
+	Session int64 // new conn and session messages
+	High    int64 // the frames of the streams by stream priority
+	Normal  int64
+	Low     int64
+}
+
+// Stats is a snapshot of the session counters of the mux
+type Stats struct {
+	Sent           FrameStats            // all the frames written
+	Received       FrameStats            // all the frames read
+	SentFrames     map[string]FrameStats // by the frame type
+	ReceivedFrames map[string]FrameStats
+	ActiveStreams  int64
+	TotalStreams   uint64 // the streams opened and accepted
+	RefusedStreams uint64 // the streams failed to open
+	Queue          QueueStats
+	RTT            RTTStats
+	Bandwidth      float64 // the estimated bytes per second can be delivered from the remote side
+	PingFailures   uint64  // the probes not answered in time
+	Memory         int64
+	SendWindow     uint64 // bytes the streams can send now, the session window of the remote side, MaxUint64 if not limited
+	ReceiveBudget  uint32 // bytes the remote side can send to all the streams
+	Uptime         time.Duration
+}
+
+type frameCounter struct {
+	frames uint64
+	bytes  uint64
+}
+
+// muxCounters is updated with atomics on the read and write path, so Stats is cheap to call
+type muxCounters struct {
+	sent           [muxFlags + 1]frameCounter
+	received       [muxFlags + 1]frameCounter
+	totalStreams   uint64
+	refusedStreams uint64
+	started        time.Time
+}
+
+func newMuxCounters() *muxCounters {
+	return &muxCounters{started: time.Now()}
+}
+
+func frameIndex(flag uint8) uint8 {
+	if flag >= muxFlags {
+		return muxFlags // extension frames, or unknown flags
+	}
+	return flag
+}
+
+func (Self *frameCounter) add(n uint32) {
+	atomic.AddUint64(&Self.frames, 1)
+	atomic.AddUint64(&Self.bytes, uint64(n))
+}
+
+func (Self *frameCounter) load() FrameStats {
+	return FrameStats{Frames: atomic.LoadUint64(&Self.frames), Bytes: atomic.LoadUint64(&Self.bytes)}
+}
+
+func (Self *muxCounters) frameSent(flag uint8, n uint32) {
+	Self.sent[frameIndex(flag)].add(n)
+}
+
+func (Self *muxCounters) frameReceived(flag uint8, n uint32) {
+	Self.received[frameIndex(flag)].add(n)
+}
+
+// Stats returns a snapshot of the session counters
+func (s *Mux) Stats() (stats Stats) {
+	stats.SentFrames = make(map[string]FrameStats, len(frameNames))
+	stats.ReceivedFrames = make(map[string]FrameStats, len(frameNames))
+	for i, name := range frameNames {
+		sent := s.counters.sent[i].load()
+		received := s.counters.received[i].load()
+		stats.SentFrames[name] = sent
+		stats.ReceivedFrames[name] = received
+		stats.Sent.Frames += sent.Frames
+		stats.Sent.Bytes += sent.Bytes
+		stats.Received.Frames += received.Frames
+		stats.Received.Bytes += received.Bytes
+	}
+	stats.ActiveStreams = s.connMap.Size()
+	stats.TotalStreams = atomic.LoadUint64(&s.counters.totalStreams)
+	stats.RefusedStreams = atomic.LoadUint64(&s.counters.refusedStreams)
+	stats.Queue = s.writeQueue.Stats()
+	stats.RTT = s.rtt.Stats()
+	stats.Bandwidth = s.bw.Get()
+	stats.PingFailures = atomic.LoadUint64(&s.pinger.failures)
+	stats.Memory = s.MemoryUsage()
+	stats.SendWindow = s.sendBudget.Remaining()
+	stats.ReceiveBudget = atomic.LoadUint32(&s.receiveBudget.budget)
+	stats.Uptime = time.Since(s.counters.started)
+	return
+}
+
+// StreamStats is a snapshot of the counters and the flow control state of a stream
+type StreamStats struct {
+	ID            int32
+	Priority      uint8
+	BytesRead     uint64 // the stream data read by the application
+	BytesReceived uint64 // the stream data received from the remote side
+	BytesWritten  uint64 // the stream data sent to the remote side
+	BytesAcked    uint64 // the stream data the remote side has read
+	Queued        uint32 // bytes received and waiting to be read
+	// ReceiveWindow is the window advertised to the remote side, the max size and the offset it can send until
+	ReceiveWindow    uint32
+	ReceiveLimit     uint64
+	RemoteWindow     uint32 // the window the remote side advertised, the offset can send until is RemoteLimit
+	RemoteLimit      uint64
+	SendAvailable    uint32        // bytes can be sent now
+	SendBlocked      time.Duration // the total time the writes waited for the remote window
+	ReadBlocked      time.Duration // the total time the reads waited for the data
+	ReadBandwidth    float64       // bytes per second the application read, zero if not measured yet
+	SessionAvailable uint64        // bytes can be sent now by all the streams, MaxUint64 if not limited
+}
+
+// Stats returns a snapshot of the counters and the flow control state of the stream,
+// e.g. SendBlocked keeps growing with a zero RemoteWindow means the remote side is not reading,
+// with a small RemoteWindow means the window is too small, while a zero SessionAvailable means the mux is congested
+func (s *conn) Stats() (stats StreamStats) {
+	receive, send := s.receiveWindow, s.sendWindow
+	stats.ID = s.connId
+	stats.Priority = send.Priority()
+	stats.BytesRead = atomic.LoadUint64(&receive.consumed)
+	stats.BytesReceived = atomic.LoadUint64(&receive.received)
+	stats.Queued = receive.bufQueue.Len()
+	stats.ReceiveWindow = atomic.LoadUint32(&receive.advertisedSize)
+	stats.ReceiveLimit = atomic.LoadUint64(&receive.advertised)
+	stats.ReadBlocked = time.Duration(atomic.LoadInt64(&receive.bufQueue.blocked))
+	stats.ReadBandwidth = receive.bw.Get()
+	stats.BytesWritten = atomic.LoadUint64(&send.sent)
+	stats.BytesAcked = atomic.LoadUint64(&send.acked)
+	stats.RemoteLimit = atomic.LoadUint64(&send.limit)
+	if stats.RemoteLimit > stats.BytesAcked {
+		stats.RemoteWindow = uint32(stats.RemoteLimit - stats.BytesAcked)
+	}
+	stats.SendAvailable = send.remainingSize()
+	stats.SendBlocked = time.Duration(atomic.LoadInt64(&send.blocked))
+	stats.SessionAvailable = receive.mux.sendBudget.Remaining()
+	return
+}
@@ -0,0 +1,103 @@
+package nps_mux
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+// defaultStreamMessageSize is the max size of the stream message if not Set
+const defaultStreamMessageSize = maximumSegmentSize * 256
+
+// ErrMessageTooLarge is returned by WriteMessage and ReadMessage for the messages larger than the max message size
+var ErrMessageTooLarge = errors.New("conn: message too large")
+
+// SetMaxMessageSize Set the max size of the message can be written by WriteMessage and read by ReadMessage,
+// the larger messages are not sent, or discarded by ReadMessage, with ErrMessageTooLarge
+func (s *conn) SetMaxMessageSize(n int) error {
+	if n <= 0 {
+		return errors.New("conn: invalid message size")
+	}
+	atomic.StoreInt64(&s.maxMessageSize, int64(n))
+	return nil
+}
+
+func (s *conn) messageSize() int {
+	if n := atomic.LoadInt64(&s.maxMessageSize); n > 0 {
+		return int(n)
+	}
+	return defaultStreamMessageSize
+}
+
+// WriteMessage send p as one message, the remote side receive exactly the same bytes from ReadMessage.
+// the last segment of it is muxNewMsg and the others are muxNewMsgPart, the writes coalesced are sent before it,
+// so the messages and the stream data can be mixed, but don't write concurrently.
+// the boundaries of Write are not kept if coalesced by SetNoDelay(false), or sent by ReadFrom,
+// use WriteMessage only if the remote side reads every Write as a message.
+func (s *conn) WriteMessage(p []byte) (err error) {
+	if s.isClose {
+		return errors.New("the conn has closed")
+	}
+	if s.closingFlag {
+		return errors.New("io: write on closed conn")
+	}
+	if len(p) == 0 {
+		return errors.New("conn: empty message")
+	}
+	if len(p) > s.messageSize() {
+		return ErrMessageTooLarge
+	}
+	s.coalescer.sending.Lock()
+	defer s.coalescer.sending.Unlock()
+	if err = s.flush(); err != nil {
+		return
+	}
+	// the message can't be coalesced with the other writes
+	_, err = s.sendWindow.WriteFull(p, s.connId)
+	return
+}
+
+// ReadMessage returns the next message written by the remote side, one WriteMessage,
+// or the data of Write sent in one go, see WriteMessage.
+// if the message is larger than the max message size, it is discarded and ErrMessageTooLarge returned,
+// the stream is still usable.
+func (s *conn) ReadMessage() (msg []byte, err error) {
+	if s.isClose {
+		return nil, errors.New("the conn has closed")
+	}
+	max := s.messageSize()
+	size := maximumSegmentSize
+	if size > max {
+		size = max
+	}
+	msg = make([]byte, 0, size)
+	var n int
+	var tooLarge bool
+	for {
+		if len(msg) == cap(msg) {
+			if len(msg) >= max {
+				msg = msg[:0] // too large, discard the rest of the message
+				tooLarge = true
+			} else {
+				size = cap(msg) * 2
+				if size > max {
+					size = max
+				}
+				buf := make([]byte, len(msg), size)
+				copy(buf, msg)
+				msg = buf
+			}
+		}
+		n, err = s.receiveWindow.Read(msg[len(msg):cap(msg)], s.connId)
+		if err != nil {
+			return nil, err
+		}
+		msg = msg[:len(msg)+n]
+		if s.receiveWindow.messageEnd() {
+			break
+		}
+	}
+	if tooLarge {
+		return nil, ErrMessageTooLarge
+	}
+	return
+}
@@ -0,0 +1,104 @@
+package nps_mux
+
+// FrameInfo is the header of a frame sent or received
+type FrameInfo struct {
+	Flag   uint8
+	Type   string // the name of the flag as in Stats, "extension" for the extension frames
+	Stream int32  // the stream id, zero or muxPing for the frames not belong to any stream
+	Length uint16 // the content length
+	Window uint64 // the window offset of the window frames, the size read since the last update for msg_send_ok
+	Size   uint32 // the window size of the stream window update
+}
+
+// StreamState is the state of a stream reported to the Tracer
+type StreamState uint8
+
+const (
+	StreamOpening StreamState = iota // the new stream request sent or received
+	StreamOpened                     // the remote side accepted the stream, or the stream accepted
+	StreamRefused                    // the remote side not accepted the stream in time
+	StreamClosing                    // the remote side closed the stream, the data queued can still be read
+	StreamClosed                     // the stream closed locally
+)
+
+func (s StreamState) String() string {
+	switch s {
+	case StreamOpening:
+		return "opening"
+	case StreamOpened:
+		return "opened"
+	case StreamRefused:
+		return "refused"
+	case StreamClosing:
+		return "closing"
+	case StreamClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// WindowEvent is a window changed, stream zero is the session window
+type WindowEvent struct {
+	Stream  int32
+	Receive bool   // the receive window advertised to the remote side, otherwise the send window updated by the remote side
+	Limit   uint64 // the absolute offset of the stream data can be sent until
+	Size    uint32 // the max size of the stream window, zero for the session window
+}
+
+// Tracer receive the frames and the state changes of a mux, the callbacks are called synchronously
+// on the read and write path, so they must be fast and never block.
+type Tracer interface {
+	FrameSent(frame FrameInfo)
+	FrameReceived(frame FrameInfo)
+	StreamStateChanged(stream int32, state StreamState)
+	WindowChanged(event WindowEvent)
+}
+
+type tracerValue struct {
+	Tracer
+}
+
+// SetTracer Set the tracer of the mux at runtime, nil to remove it, the cost is an atomic load per event if not Set
+func (s *Mux) SetTracer(tracer Tracer) {
+	s.tracer.Store(tracerValue{tracer})
+}
+
+func (s *Mux) getTracer() Tracer {
+	if v, ok := s.tracer.Load().(tracerValue); ok {
+		return v.Tracer
+	}
+	return nil
+}
+
+func (s *Mux) traceStream(id int32, state StreamState) {
+	if tracer := s.getTracer(); tracer != nil {
+		tracer.StreamStateChanged(id, state)
+	}
+}
+
+func (s *Mux) traceWindow(id int32, receive bool, limit uint64, size uint32) {
+	if tracer := s.getTracer(); tracer != nil {
+		tracer.WindowChanged(WindowEvent{Stream: id, Receive: receive, Limit: limit, Size: size})
+	}
+}
+
+func (Self *muxPackager) frameInfo() FrameInfo {
+	info := FrameInfo{
+		Flag:   Self.flag,
+		Type:   frameNames[frameIndex(Self.flag)],
+		Stream: Self.id,
+		Length: Self.length,
+		Window: Self.window,
+		Size:   Self.size,
+	}
+	info.legacyWindow()
+	return info
+}
+
+// legacyWindow decode the window of the old peers window update
+func (Self *FrameInfo) legacyWindow() {
+	if Self.Flag == muxMsgSendOk {
+		maxSize, read := unpackLegacyWindow(Self.Window)
+		Self.Window, Self.Size = uint64(read), maxSize
+	}
+}